@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"broker-manager/services"
+	"broker-manager/websockets"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Define flags for the admin API.
+var (
+	adminAddr  = flag.String("admin-addr", "", "network address for the admin HTTP API, empty to disable it")
+	adminToken = flag.String("admin-token", "", "Bearer token required by the admin HTTP API")
+)
+
+// Revoker revokes cached credentials and disconnects the clients using them.
+type Revoker interface {
+	Revoke(filter services.RevocationFilter) (tokens int, clients int, err error)
+}
+
+// Cache inspects and evicts cached authentication tokens.
+type Cache interface {
+	CacheEntries(filter services.CacheFilter) []services.CacheEntry
+	Evict(clientId, username string) bool
+	Flush() int
+}
+
+// RevokeResponse reports the outcome of a revocation.
+type RevokeResponse struct {
+	RevokedTokens       int `json:"revoked_tokens"`
+	DisconnectedClients int `json:"disconnected_clients"`
+}
+
+// Serve starts the admin HTTP API in the background if an address is configured.
+func Serve(revoker Revoker, cache Cache) error {
+	if *adminAddr == "" {
+		return nil
+	}
+
+	if *adminToken == "" {
+		return errors.New("admin-token is required when admin-addr is set")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /auth/revoke", authenticated(revokeHandler(revoker)))
+	mux.Handle("GET /auth/cache", authenticated(listCacheHandler(cache)))
+	mux.Handle("DELETE /auth/cache/entry", authenticated(evictHandler(cache)))
+	mux.Handle("DELETE /auth/cache", authenticated(flushHandler(cache)))
+	mux.Handle("GET /reverb/status", authenticated(reverbStatusHandler()))
+
+	server := &http.Server{
+		Addr:              *adminAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Println("admin:", err)
+		}
+	}()
+
+	return nil
+}
+
+// authenticated rejects requests without the configured bearer token.
+func authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "unauthorized"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revokeHandler revokes the credentials selected by the JSON body.
+func revokeHandler(revoker Revoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter services.RevocationFilter
+		if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+
+		tokens, clients, err := revoker.Revoke(filter)
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, RevokeResponse{RevokedTokens: tokens, DisconnectedClients: clients})
+	}
+}
+
+// reverbStatusHandler reports the state of the connection to Reverb.
+func reverbStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, websockets.CurrentStatus())
+	}
+}
+
+// writeJSON writes a JSON response with the status code.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"broker-manager/services"
+	"net/http"
+	"strconv"
+)
+
+// CacheResponse lists cached authentication tokens.
+type CacheResponse struct {
+	Entries []services.CacheEntry `json:"entries"`
+}
+
+// EvictResponse reports the number of cache entries removed by an eviction or flush.
+type EvictResponse struct {
+	Evicted int `json:"evicted"`
+}
+
+// listCacheHandler lists the cached tokens, optionally filtered by the team_id, client_id and username
+// query parameters.
+func listCacheHandler(cache Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := services.CacheFilter{
+			ClientID: query.Get("client_id"),
+			Username: query.Get("username"),
+		}
+
+		if teamId := query.Get("team_id"); teamId != "" {
+			id, err := strconv.ParseUint(teamId, 10, 64)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": "invalid team_id"})
+				return
+			}
+			filter.TeamID = id
+		}
+
+		writeJSON(w, http.StatusOK, CacheResponse{Entries: cache.CacheEntries(filter)})
+	}
+}
+
+// evictHandler removes the cached token of the client given by the client_id and username query parameters.
+func evictHandler(cache Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !query.Has("client_id") || !query.Has("username") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "client_id and username are required"})
+			return
+		}
+
+		if !cache.Evict(query.Get("client_id"), query.Get("username")) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "no cached token for the client"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, EvictResponse{Evicted: 1})
+	}
+}
+
+// flushHandler removes every cached token.
+func flushHandler(cache Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, EvictResponse{Evicted: cache.Flush()})
+	}
+}
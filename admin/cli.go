@@ -0,0 +1,172 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// cliUsage describes the auth subcommand.
+const cliUsage = `Usage: broker-manager auth <command> [flags]
+
+Commands:
+  list    List cached tokens, filtered by -team-id, -client-id or -username
+  evict   Remove the cached token of -client-id and -username
+  flush   Remove every cached token
+
+Flags:
+`
+
+// RunCLI runs the auth subcommand against the admin API of a running broker and returns the exit code.
+func RunCLI(args []string) int {
+	flags := flag.NewFlagSet("auth", flag.ContinueOnError)
+	addr := flags.String("admin-url", "http://127.0.0.1:8081", "base URL of the broker's admin API")
+	token := flags.String("admin-token", os.Getenv("BROKER_ADMIN_TOKEN"), "Bearer token of the admin API, defaults to $BROKER_ADMIN_TOKEN")
+	teamId := flags.Uint64("team-id", 0, "only list tokens of this team")
+	clientId := flags.String("client-id", "", "MQTT client ID of the token")
+	username := flags.String("username", "", "MQTT username of the token")
+	asJSON := flags.Bool("json", false, "print the raw JSON response")
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(flags.Output(), cliUsage)
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	query := url.Values{}
+	var method string
+	var path string
+	switch command {
+	case "list":
+		method, path = http.MethodGet, "/auth/cache"
+		if *teamId != 0 {
+			query.Set("team_id", strconv.FormatUint(*teamId, 10))
+		}
+		if *clientId != "" {
+			query.Set("client_id", *clientId)
+		}
+		if *username != "" {
+			query.Set("username", *username)
+		}
+	case "evict":
+		method, path = http.MethodDelete, "/auth/cache/entry"
+		query.Set("client_id", *clientId)
+		query.Set("username", *username)
+	case "flush":
+		method, path = http.MethodDelete, "/auth/cache"
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	body, err := call(method, *addr+path+"?"+query.Encode(), *token)
+	if err != nil {
+		fmt.Println("Error calling the admin API:", err)
+		return 1
+	}
+
+	if *asJSON {
+		fmt.Print(string(body))
+		return 0
+	}
+
+	if err = printResult(command, body); err != nil {
+		fmt.Println("Error decoding the admin API response:", err)
+		return 1
+	}
+
+	return 0
+}
+
+// call sends an authenticated request to the admin API and returns the body of a successful response.
+func call(method, target, token string) ([]byte, error) {
+	request, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &failure) != nil || failure.Message == "" {
+			failure.Message = response.Status
+		}
+
+		return nil, errors.New(failure.Message)
+	}
+
+	return body, nil
+}
+
+// printResult prints a response of the admin API in a human-readable form.
+func printResult(command string, body []byte) error {
+	if command != "list" {
+		var result EvictResponse
+		if err := json.Unmarshal(body, &result); err != nil {
+			return err
+		}
+
+		fmt.Printf("Evicted %d cached token(s)\n", result.Evicted)
+		return nil
+	}
+
+	var result CacheResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "CLIENT ID\tUSERNAME\tTEAM\tMQTT CLIENT\tAPI TOKEN\tEXPIRES\tLAST USED")
+	for _, entry := range result.Entries {
+		expires := formatUnix(entry.ExpiresAt)
+		if entry.Expired {
+			expires += " (expired)"
+		}
+
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", entry.ClientID, entry.Username, entry.TeamID,
+			entry.MqttClientID, entry.ApiTokenID, expires, formatUnix(entry.LastUsed))
+	}
+
+	return table.Flush()
+}
+
+// formatUnix formats a UNIX timestamp in local time, or a dash if it is unset.
+func formatUnix(timestamp uint64) string {
+	if timestamp == 0 {
+		return "-"
+	}
+
+	return time.Unix(int64(timestamp), 0).Format(time.RFC3339)
+}
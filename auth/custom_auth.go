@@ -7,14 +7,55 @@ package auth
 import (
 	"broker-manager/services"
 	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
 )
 
+// Service authenticates connecting clients and authorizes their topic access.
+// It is implemented by services.AuthService.
+type Service interface {
+	Authenticate(clientId, username, password string) error
+	AuthenticateCertificate(clientId, username string, certificate *x509.Certificate) error
+	Reauthenticate(clientId, username, password string) error
+	ReauthenticateCertificate(clientId, username string, certificate *x509.Certificate) error
+	Authorize(clientId, username, topic string, write bool) error
+	Lookup(clientId, username string) *services.AuthenticatedToken
+	Revoke(filter services.RevocationFilter) ([]string, error)
+	Forget(clientId, username string)
+}
+
+// CustomAuthOptions contains the configuration of the CustomAuth hook.
+type CustomAuthOptions struct {
+	Server  *mqtt.Server         // Server used to reject clients with a specific CONNACK reason code
+	Service Service              // Service used to authenticate and authorize clients
+	Guard   *services.LoginGuard // Guard rejecting brute-force attempts before they reach the service, nil if disabled
+	Limiter Limiter              // Limiter refusing connections and subscriptions over quota, nil if disabled
+}
+
+// Limiter refuses connections and subscriptions exceeding a quota.
+// It is implemented by hooks.TeamQuota.
+type Limiter interface {
+	AdmitConnection(cl *mqtt.Client) error
+	RejectsSubscription(cl *mqtt.Client, filter string) bool
+}
+
 // CustomAuth validates credentials with external services
 type CustomAuth struct {
 	mqtt.HookBase
+	server        *mqtt.Server
+	service       Service
+	guard         *services.LoginGuard
+	limiter       Limiter
+	authenticated sync.Map // Clients that passed authentication in OnConnect
+	sessions      sync.Map // Sessions of connected clients by client ID, re-authenticated by the supervisor
+	subscribing   sync.Map // Filters of the SUBSCRIBE packet being processed, by client
+	stop          context.CancelFunc
 }
 
 // ID returns the ID of the hook.
@@ -22,30 +63,290 @@ func (h *CustomAuth) ID() string {
 	return "custom-auth"
 }
 
+// Init configures the hook with the server and the authentication service it depends on.
+func (h *CustomAuth) Init(config any) error {
+	options, ok := config.(*CustomAuthOptions)
+	if !ok || options == nil || options.Server == nil || options.Service == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.server = options.Server
+	h.service = options.Service
+	h.guard = options.Guard
+	h.limiter = options.Limiter
+	return nil
+}
+
 // Provides indicates which hook methods this hook provides.
 func (h *CustomAuth) Provides(b byte) bool {
 	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnConnect,
 		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribe,
+		mqtt.OnSubscribed,
 		mqtt.OnACLCheck,
+		mqtt.OnWill,
 	}, []byte{b})
 }
 
-// OnConnectAuthenticate returns true/allowed for all requests.
-func (h *CustomAuth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+// OnConnect authenticates the client's credentials or certificate, checks the topic of its last will and the
+// connection quota of its team.
+// Rejected clients receive a CONNACK with the reason code matching the rejection, and the returned code stops the
+// connection. The session is only kept once the client is admitted, as mochi does not call OnDisconnect for
+// connections refused in OnConnect.
+func (h *CustomAuth) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	// Clients using enhanced authentication are authenticated by ScramAuth.
+	if services.ScramEnabled() && pk.Properties.AuthenticationMethod != "" {
+		return nil
+	}
+
 	h.Log.Info("Authenticating",
 		"username", string(pk.Connect.Username),
 		"remote", cl.Net.Remote)
 
-	return services.AuthServiceInstance.Authenticate(
-		cl.ID, string(pk.Connect.Username), string(pk.Connect.Password))
+	current := newSession(cl, pk)
+	err := h.admit(current)
+	if err == nil {
+		err = authorizeWill(h.service.Authorize, cl)
+	}
+
+	if err == nil && h.limiter != nil {
+		err = h.limiter.AdmitConnection(cl)
+	}
+
+	if err == nil {
+		h.authenticated.Store(cl, true)
+		// The session of a connection being taken over is no longer needed.
+		if previous, loaded := h.sessions.Swap(cl.ID, current); loaded {
+			previous.(*session).forget()
+		}
+		return nil
+	}
+
+	current.forget()
+	services.AccessDenied(services.AccessDeniedEvent{
+		ClientID:  cl.ID,
+		Username:  current.username,
+		Remote:    cl.Net.Remote,
+		Direction: services.DirectionConnect,
+		Reason:    err.Error(),
+	})
+
+	code := services.ReasonCode(err)
+	if sendErr := h.server.SendConnack(cl, connackCode(cl, code), false, nil); sendErr != nil {
+		return fmt.Errorf("invalid connection send ack: %w", sendErr)
+	}
+
+	return code
+}
+
+// OnWill drops the last will of a client whose token no longer allows its topic, e.g. once it was revoked or
+// expired. mochi only logs errors returned by OnWill, so the will is dropped by clearing it: a will without a
+// topic matches no subscription and is not retained.
+func (h *CustomAuth) OnWill(cl *mqtt.Client, will mqtt.Will) (mqtt.Will, error) {
+	if will.TopicName == "" {
+		return will, nil
+	}
+
+	username := string(cl.Properties.Username)
+	if err := h.service.Authorize(cl.ID, username, will.TopicName, true); err != nil {
+		h.Log.Info("Dropping last will", "client", cl.ID, "topic", will.TopicName, "error", err)
+		services.AccessDenied(services.AccessDeniedEvent{
+			ClientID:  cl.ID,
+			Username:  username,
+			Remote:    cl.Net.Remote,
+			Direction: services.DirectionWrite,
+			Topic:     will.TopicName,
+			Reason:    err.Error(),
+		})
+		return mqtt.Will{}, nil
+	}
+
+	return will, nil
+}
+
+// authorizeWill checks the topic of the last will a client connects with against its write ACL, as mochi
+// publishes wills without an ACL check.
+func authorizeWill(authorize func(clientId, username, topic string, write bool) error, cl *mqtt.Client) error {
+	if atomic.LoadUint32(&cl.Properties.Will.Flag) == 0 {
+		return nil
+	}
+
+	if err := authorize(cl.ID, string(cl.Properties.Username), cl.Properties.Will.TopicName, true); err != nil {
+		return fmt.Errorf("%w: will topic: %w", packets.ErrNotAuthorized, err)
+	}
+
+	return nil
+}
+
+// connackCode returns the CONNACK reason code of a rejection for the client's protocol version. mochi does not
+// convert not authorized to its MQTT v3 return code.
+func connackCode(cl *mqtt.Client, code packets.Code) packets.Code {
+	if cl.Properties.ProtocolVersion < 5 && code == packets.ErrNotAuthorized {
+		return packets.Err3NotAuthorized
+	}
+
+	return code
+}
+
+// OnConnectAuthenticate returns true/allowed if the client passed authentication in OnConnect.
+func (h *CustomAuth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	_, ok := h.authenticated.LoadAndDelete(cl)
+	return ok
+}
+
+// OnDisconnect forgets the session and the cached ACL decisions of the client, unless it was already taken over
+// by a new connection.
+func (h *CustomAuth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.authenticated.Delete(cl)
+	h.subscribing.Delete(cl)
+	if current, ok := h.sessions.Load(cl.ID); ok && current.(*session).client == cl {
+		h.sessions.CompareAndDelete(cl.ID, current)
+		current.(*session).forget()
+	}
+
+	if current, ok := h.server.Clients.Get(cl.ID); ok && current != cl {
+		return
+	}
+
+	h.service.Forget(cl.ID, string(cl.Properties.Username))
+}
+
+// OnSubscribe remembers the filters being subscribed, so their denials can be told apart from those of deliveries.
+// Filters are stored before TeamNamespace mounts them.
+func (h *CustomAuth) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	filters := make(map[string]bool, len(pk.Filters))
+	for _, filter := range pk.Filters {
+		filters[filter.Filter] = true
+	}
+
+	h.subscribing.Store(cl, filters)
+	return pk
+}
+
+// OnSubscribed forgets the filters of the processed SUBSCRIBE packet.
+func (h *CustomAuth) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.subscribing.Delete(cl)
+}
+
+// subscribes returns true if the client is subscribing to the filter, as opposed to receiving a message.
+func (h *CustomAuth) subscribes(cl *mqtt.Client, filter string) bool {
+	filters, ok := h.subscribing.Load(cl)
+	return ok && filters.(map[string]bool)[filter]
+}
+
+// Revoke removes the cached tokens selected by the filter and disconnects the clients using them.
+// It returns the number of revoked tokens and disconnected clients.
+func (h *CustomAuth) Revoke(filter services.RevocationFilter) (int, int, error) {
+	revoked, err := h.service.Revoke(filter)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	keys := make(map[string]bool, len(revoked))
+	for _, authKey := range revoked {
+		keys[authKey] = true
+	}
+
+	// Every connected client is checked, whichever hook authenticated it.
+	disconnected := 0
+	for _, cl := range h.server.Clients.GetAll() {
+		username := string(cl.Properties.Username)
+		if cl.Closed() || !keys[cl.ID+"::"+username] {
+			continue
+		}
+
+		h.Log.Info("Disconnecting revoked client", "client", cl.ID, "username", username)
+		_ = h.server.DisconnectClient(cl, services.ErrRevoked)
+		disconnected++
+	}
+
+	return len(revoked), disconnected, nil
+}
+
+// admit authenticates a connecting client, unless the login guard rejects the attempt first.
+func (h *CustomAuth) admit(current *session) error {
+	if h.guard == nil {
+		return h.authenticate(current)
+	}
+
+	ip := remoteIP(current.client)
+	if err := h.guard.Check(current.client.ID, current.username, ip, current.secret()); err != nil {
+		h.Log.Info("Authentication refused", "client", current.client.ID, "remote", ip, "error", err)
+		return err
+	}
+
+	err := h.authenticate(current)
+	if err != nil {
+		h.guard.Failed(current.client.ID, current.username, ip, current.secret(), err)
+	} else {
+		h.guard.Succeeded(current.client.ID, current.username, ip)
+	}
+
+	return err
 }
 
-// OnACLCheck returns true/allowed for all checks.
+// authenticate verifies the session by its certificate or its username and password.
+func (h *CustomAuth) authenticate(current *session) error {
+	// Clients presenting a verified certificate are authenticated by it instead of their password.
+	if current.certificate != nil {
+		return h.service.AuthenticateCertificate(current.client.ID, current.username, current.certificate)
+	}
+
+	return h.service.Authenticate(current.client.ID, current.username, current.secret())
+}
+
+// OnACLCheck returns true/allowed if the client's cached token allows the topic in the requested direction.
+// Denied publishes and subscriptions are recorded in the audit log. Denied deliveries are not, as a single
+// publish would be recorded once for every subscriber.
 func (h *CustomAuth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
-	h.Log.Info("Authenticating ACL",
+	username := string(cl.Properties.Username)
+	h.Log.Debug("Authenticating ACL",
 		"client", cl.ID,
-		"username", string(cl.Properties.Username),
-		"topic", topic)
+		"username", username,
+		"topic", topic,
+		"write", write)
+
+	// Subscriptions over the team's quota are refused whatever the client's permissions.
+	var err error
+	if !write && h.limiter != nil && h.limiter.RejectsSubscription(cl, topic) {
+		err = packets.ErrQuotaExceeded
+	} else {
+		err = h.service.Authorize(cl.ID, username, topic, write)
+	}
+
+	if err == nil {
+		return true
+	}
+
+	direction := services.DirectionRead
+	if write {
+		direction = services.DirectionWrite
+	}
+
+	event := services.AccessDeniedEvent{
+		ClientID:  cl.ID,
+		Username:  username,
+		Remote:    cl.Net.Remote,
+		Direction: direction,
+		Topic:     topic,
+		Reason:    err.Error(),
+	}
+	if token := h.service.Lookup(cl.ID, username); token != nil {
+		event.TeamID = token.TeamID
+		if !write {
+			event.Topic, _ = token.UnmountTopic(topic)
+		}
+	}
+
+	if !write && !h.subscribes(cl, event.Topic) {
+		h.Log.Debug("Delivery denied", "client", cl.ID, "topic", event.Topic, "error", err)
+		return false
+	}
 
-	return services.AuthServiceInstance.Authenticate(cl.ID, string(cl.Properties.Username), "")
+	services.AccessDenied(event)
+	return false
 }
@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"broker-manager/services"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// exchangeTimeout bounds how long a connecting client may take to answer the server-first message.
+const exchangeTimeout = 30 * time.Second
+
+// ScramService runs the server side of SCRAM-SHA-256 exchanges.
+// It is implemented by services.AuthService.
+type ScramService interface {
+	StartScram(clientId, username string, clientFirst []byte) (*services.ScramExchange, []byte, error)
+	FinishScram(exchange *services.ScramExchange, clientFinal []byte) ([]byte, error)
+	Authorize(clientId, username, topic string, write bool) error
+	Lookup(clientId, username string) *services.AuthenticatedToken
+}
+
+// ScramAuthOptions contains the configuration of the ScramAuth hook.
+type ScramAuthOptions struct {
+	Server  *mqtt.Server         // Server used to reject clients with a specific CONNACK reason code
+	Service ScramService         // Service verifying the exchanges
+	Guard   *services.LoginGuard // Guard rejecting brute-force attempts before they reach the service, nil if disabled
+	Limiter Limiter              // Limiter refusing connections over quota, nil if disabled
+}
+
+// ScramAuth authenticates MQTT v5 clients with SCRAM-SHA-256 through AUTH packet exchanges, so their secret
+// never crosses the wire. Clients connecting without an authentication method are left to CustomAuth.
+type ScramAuth struct {
+	mqtt.HookBase
+	server        *mqtt.Server
+	service       ScramService
+	guard         *services.LoginGuard
+	limiter       Limiter
+	authenticated sync.Map // Server-final messages of clients that passed the exchange in OnConnect, sent in the CONNACK
+	exchanges     sync.Map // Re-authentication exchanges in progress by client
+	sessions      sync.Map // Sessions of connected clients by client ID, checked by the supervisor
+	stop          context.CancelFunc
+}
+
+// ID returns the ID of the hook.
+func (h *ScramAuth) ID() string {
+	return "scram-auth"
+}
+
+// Init configures the hook with the server and the service it depends on.
+func (h *ScramAuth) Init(config any) error {
+	options, ok := config.(*ScramAuthOptions)
+	if !ok || options == nil || options.Server == nil || options.Service == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.server = options.Server
+	h.service = options.Service
+	h.guard = options.Guard
+	h.limiter = options.Limiter
+	return nil
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *ScramAuth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnConnect,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnAuthPacket,
+		mqtt.OnPacketEncode,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// OnConnect runs the SCRAM exchange of clients connecting with an authentication method, checks the topic of their
+// last will and the connection quota of their team. Rejected clients receive a CONNACK with the reason code matching the rejection, and the
+// returned code stops the connection.
+func (h *ScramAuth) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	method := pk.Properties.AuthenticationMethod
+	if method == "" {
+		return nil
+	}
+
+	h.Log.Info("Authenticating",
+		"method", method,
+		"remote", cl.Net.Remote)
+
+	var serverFinal []byte
+	err := error(packets.ErrBadAuthenticationMethod)
+	if method == services.ScramSHA256 {
+		serverFinal, err = h.exchange(cl, pk)
+	}
+
+	if err == nil {
+		err = authorizeWill(h.service.Authorize, cl)
+	}
+
+	if err == nil && h.limiter != nil {
+		err = h.limiter.AdmitConnection(cl)
+	}
+
+	if err == nil {
+		h.authenticated.Store(cl, serverFinal)
+		h.sessions.Store(cl.ID, newScramSession(cl))
+		return nil
+	}
+
+	services.AccessDenied(services.AccessDeniedEvent{
+		ClientID:  cl.ID,
+		Username:  string(cl.Properties.Username),
+		Remote:    cl.Net.Remote,
+		Direction: services.DirectionConnect,
+		Reason:    err.Error(),
+	})
+
+	code := services.ReasonCode(err)
+	if sendErr := h.server.SendConnack(cl, connackCode(cl, code), false, nil); sendErr != nil {
+		return fmt.Errorf("invalid connection send ack: %w", sendErr)
+	}
+
+	return code
+}
+
+// OnConnectAuthenticate returns true/allowed if the client passed the exchange in OnConnect.
+func (h *ScramAuth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	_, ok := h.authenticated.Load(cl)
+	return ok
+}
+
+// OnPacketEncode adds the server-final message to the CONNACK of a client that passed the exchange.
+func (h *ScramAuth) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type != packets.Connack || pk.ReasonCode != packets.CodeSuccess.Code {
+		return pk
+	}
+
+	if serverFinal, ok := h.authenticated.LoadAndDelete(cl); ok {
+		pk.Properties.AuthenticationMethod = services.ScramSHA256
+		pk.Properties.AuthenticationData = serverFinal.([]byte)
+	}
+
+	return pk
+}
+
+// OnAuthPacket re-authenticates a connected client. Failed re-authentications return a reason code, which
+// disconnects the client.
+func (h *ScramAuth) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Properties.Props.AuthenticationMethod != services.ScramSHA256 ||
+		pk.Properties.AuthenticationMethod != cl.Properties.Props.AuthenticationMethod {
+		return pk, packets.ErrProtocolViolation
+	}
+
+	switch pk.ReasonCode {
+	case packets.CodeReAuthenticate.Code:
+		exchange, serverFirst, err := h.service.StartScram(cl.ID, string(cl.Properties.Username), pk.Properties.AuthenticationData)
+		if err != nil {
+			return pk, reauthenticationCode(err)
+		}
+
+		h.exchanges.Store(cl, exchange)
+		return pk, h.sendAuth(cl, packets.CodeContinueAuthentication, serverFirst)
+	case packets.CodeContinueAuthentication.Code:
+		exchange, ok := h.exchanges.LoadAndDelete(cl)
+		if !ok {
+			return pk, packets.ErrProtocolViolation
+		}
+
+		serverFinal, err := h.service.FinishScram(exchange.(*services.ScramExchange), pk.Properties.AuthenticationData)
+		if err != nil {
+			h.Log.Info("Re-authentication failed", "client", cl.ID, "error", err)
+			return pk, reauthenticationCode(err)
+		}
+
+		if current, ok := h.sessions.Load(cl.ID); ok && current.(*session).client == cl {
+			h.sessions.Store(cl.ID, newScramSession(cl))
+		}
+
+		return pk, h.sendAuth(cl, packets.CodeSuccess, serverFinal)
+	default:
+		return pk, packets.ErrProtocolViolation
+	}
+}
+
+// OnDisconnect forgets the exchanges and the session of the client, unless it was already taken over by a new
+// connection.
+func (h *ScramAuth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.authenticated.Delete(cl)
+	h.exchanges.Delete(cl)
+	if current, ok := h.sessions.Load(cl.ID); ok && current.(*session).client == cl {
+		h.sessions.CompareAndDelete(cl.ID, current)
+	}
+}
+
+// newScramSession records a client that just passed an exchange. It holds no secret, as the exchange cannot be
+// run again without the client.
+func newScramSession(cl *mqtt.Client) *session {
+	return &session{
+		client:        cl,
+		username:      string(cl.Properties.Username),
+		authenticated: time.Now(),
+	}
+}
+
+// OnStarted starts the supervisor checking the sessions of connected clients.
+func (h *ScramAuth) OnStarted() {
+	h.stop = startSupervisor(h.superviseSessions)
+}
+
+// OnStopped stops the session supervisor.
+func (h *ScramAuth) OnStopped() {
+	if h.stop != nil {
+		h.stop()
+	}
+}
+
+// superviseSessions disconnects clients whose token expired or whose session exceeded the maximum age since they
+// last authenticated. The broker cannot run the exchange on their behalf, so they must re-authenticate with an
+// AUTH packet before then, or reconnect.
+func (h *ScramAuth) superviseSessions() {
+	h.sessions.Range(func(_, value any) bool {
+		current := value.(*session)
+		if !current.outlived(h.service.Lookup) {
+			return true
+		}
+
+		cl := current.client
+		h.Log.Info("Session expired, disconnecting", "client", cl.ID, "username", current.username)
+		if err := h.server.DisconnectClient(cl, packets.ErrNotAuthorized); err != nil && !errors.Is(err, packets.ErrNotAuthorized) {
+			h.Log.Warn("Disconnecting client failed", "client", cl.ID, "error", err)
+		}
+
+		return true
+	})
+}
+
+// exchange runs the SCRAM exchange of a connecting client and returns the server-final message. The login guard
+// is checked before the credential material is fetched, so refused attempts never reach the panel.
+func (h *ScramAuth) exchange(cl *mqtt.Client, pk packets.Packet) ([]byte, error) {
+	ip := remoteIP(cl)
+	if h.guard != nil {
+		username, err := services.ScramUsername(pk.Properties.AuthenticationData)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = h.guard.Check(cl.ID, username, ip, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	exchange, serverFirst, err := h.service.StartScram(cl.ID, string(pk.Connect.Username), pk.Properties.AuthenticationData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = h.sendAuth(cl, packets.CodeContinueAuthentication, serverFirst); err != nil {
+		return nil, err
+	}
+
+	response, err := h.readAuth(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.ReasonCode != packets.CodeContinueAuthentication.Code ||
+		response.Properties.AuthenticationMethod != services.ScramSHA256 {
+		return nil, packets.ErrProtocolViolation
+	}
+
+	clientFinal := response.Properties.AuthenticationData
+	serverFinal, err := h.service.FinishScram(exchange, clientFinal)
+	if h.guard != nil {
+		if err != nil {
+			h.guard.Failed(cl.ID, exchange.Username, ip, string(clientFinal), err)
+		} else {
+			h.guard.Succeeded(cl.ID, exchange.Username, ip)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients may leave the username out of the CONNECT packet, as the exchange carries it.
+	cl.Properties.Username = []byte(exchange.Username)
+	return serverFinal, nil
+}
+
+// sendAuth sends an AUTH packet with SCRAM data to the client.
+func (h *ScramAuth) sendAuth(cl *mqtt.Client, code packets.Code, data []byte) error {
+	return cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: services.ScramSHA256,
+			AuthenticationData:   data,
+		},
+	})
+}
+
+// readAuth reads the AUTH packet a connecting client answers with. The client's read loop only starts once it
+// is connected, so the packet is read here directly.
+func (h *ScramAuth) readAuth(cl *mqtt.Client) (packets.Packet, error) {
+	_ = cl.Net.Conn.SetReadDeadline(time.Now().Add(exchangeTimeout))
+
+	var header packets.FixedHeader
+	if err := cl.ReadFixedHeader(&header); err != nil {
+		return packets.Packet{}, err
+	}
+
+	if header.Type != packets.Auth {
+		return packets.Packet{}, packets.ErrProtocolViolation
+	}
+
+	return cl.ReadPacket(&header)
+}
+
+// reauthenticationCode converts a failed re-authentication into a reason code allowed in DISCONNECT packets.
+func reauthenticationCode(err error) packets.Code {
+	code := services.ReasonCode(err)
+	if code == packets.ErrServerUnavailable {
+		return packets.ErrServerBusy
+	}
+
+	return disconnectCode(code)
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"broker-manager/services"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Define flags for the session supervisor.
+var (
+	maxSessionAge        = flag.Duration("auth-max-session-age", 0, "Time after which connected clients are re-authenticated, 0 to only re-authenticate expired tokens")
+	sessionCheckInterval = flag.Duration("auth-session-check-interval", time.Minute, "Interval for checking connected clients for expired tokens and sessions")
+)
+
+// session is an authenticated connection, kept in memory to re-authenticate it while it stays connected.
+// Re-authenticating a password client means sending its password to the backend again, so the password is kept
+// for as long as the client stays connected and zeroed once it disconnects. Certificate clients keep no password.
+type session struct {
+	client        *mqtt.Client
+	username      string
+	certificate   *x509.Certificate
+	authenticated time.Time
+	mu            sync.Mutex
+	password      []byte // Guarded by mu, nil once forgotten
+}
+
+// newSession collects the credentials a client connected with.
+func newSession(cl *mqtt.Client, pk packets.Packet) *session {
+	current := &session{
+		client:        cl,
+		username:      string(pk.Connect.Username),
+		authenticated: time.Now(),
+	}
+
+	if services.CertificateAuthEnabled() {
+		current.certificate = services.ClientCertificate(cl.Net.Conn)
+	}
+
+	if current.certificate == nil {
+		current.password = bytes.Clone(pk.Connect.Password)
+	}
+
+	return current
+}
+
+// secret returns what the client authenticated with: the fingerprint of its certificate or its password.
+func (s *session) secret() string {
+	if s.certificate != nil {
+		return services.NewCertificateIdentity(s.certificate).Fingerprint
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.password)
+}
+
+// forget zeroes the password of the session once its client is gone.
+func (s *session) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.password)
+	s.password = nil
+}
+
+// reauthenticate verifies the session again by its certificate or its username and password, bypassing the
+// cached token.
+func (h *CustomAuth) reauthenticate(current *session) error {
+	if current.certificate != nil {
+		return h.service.ReauthenticateCertificate(current.client.ID, current.username, current.certificate)
+	}
+
+	return h.service.Reauthenticate(current.client.ID, current.username, current.secret())
+}
+
+// remoteIP returns the IP address of a client without its port.
+func remoteIP(cl *mqtt.Client) string {
+	host, _, err := net.SplitHostPort(cl.Net.Remote)
+	if err != nil {
+		return cl.Net.Remote
+	}
+
+	return host
+}
+
+// OnStarted starts the supervisor re-authenticating connected clients.
+func (h *CustomAuth) OnStarted() {
+	h.stop = startSupervisor(h.superviseSessions)
+}
+
+// startSupervisor runs the check every session check interval until the returned function is called.
+func startSupervisor(check func()) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		ticker := time.NewTicker(*sessionCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// outlived returns true if the session's token expired or the session exceeded the maximum age.
+func (s *session) outlived(lookup func(clientId, username string) *services.AuthenticatedToken) bool {
+	expired := lookup(s.client.ID, s.username) == nil
+	tooOld := *maxSessionAge > 0 && time.Since(s.authenticated) >= *maxSessionAge
+	return expired || tooOld
+}
+
+// OnStopped stops the session supervisor.
+func (h *CustomAuth) OnStopped() {
+	if h.stop != nil {
+		h.stop()
+	}
+}
+
+// superviseSessions re-authenticates clients whose token expired or whose session exceeded the maximum age,
+// disconnecting those that fail.
+func (h *CustomAuth) superviseSessions() {
+	h.sessions.Range(func(_, value any) bool {
+		current := value.(*session)
+		cl := current.client
+
+		if !current.outlived(h.service.Lookup) {
+			return true
+		}
+
+		// The backend decides again, the cached token is kept until it answers.
+		err := h.reauthenticate(current)
+		if err == nil {
+			current.authenticated = time.Now()
+			return true
+		}
+
+		code := services.ReasonCode(err)
+		if code == packets.ErrServerUnavailable {
+			return true // The backend is unreachable, try again on the next check.
+		}
+
+		h.Log.Info("Re-authentication failed, disconnecting",
+			"client", cl.ID,
+			"username", current.username,
+			"error", err)
+
+		if err = h.server.DisconnectClient(cl, disconnectCode(code)); err != nil && !errors.Is(err, code) {
+			h.Log.Warn("Disconnecting client failed", "client", cl.ID, "error", err)
+		}
+
+		return true
+	})
+}
+
+// disconnectCode converts a CONNACK rejection into a reason code allowed in DISCONNECT packets.
+func disconnectCode(code packets.Code) packets.Code {
+	switch code.Code {
+	case packets.ErrNotAuthorized.Code, packets.ErrServerBusy.Code, packets.ErrQuotaExceeded.Code,
+		packets.ErrAdministrativeAction.Code:
+		return code
+	default:
+		return packets.ErrNotAuthorized
+	}
+}
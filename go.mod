@@ -2,10 +2,15 @@ module broker-manager
 
 go 1.23
 
-require github.com/mochi-mqtt/server/v2 v2.6.6
+require (
+	github.com/gorilla/websocket v1.5.0
+	github.com/mochi-mqtt/server/v2 v2.6.6
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/rs/xid v1.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,45 @@
+package hooks
+
+import (
+	"broker-manager/services"
+	"bytes"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// connectedTokens holds the token each connected client was admitted with, by client.
+var connectedTokens sync.Map
+
+// ClientTeams remembers the token every client connected with, so its team and namespace stay known when the
+// token is revoked, evicted or expires while the client is connected. It must be added after the other hooks,
+// so a client is only forgotten once they handled its disconnection and last will.
+type ClientTeams struct {
+	mqtt.HookBase
+}
+
+// ID returns the ID of the hook.
+func (h *ClientTeams) ID() string {
+	return "client-teams"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *ClientTeams) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// OnSessionEstablished remembers the token the client was admitted with.
+func (h *ClientTeams) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if token := services.AuthServiceInstance.Lookup(cl.ID, string(cl.Properties.Username)); token != nil {
+		connectedTokens.Store(cl, token)
+	}
+}
+
+// OnDisconnect forgets the token of the client.
+func (h *ClientTeams) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	connectedTokens.Delete(cl)
+}
@@ -1,6 +1,7 @@
 package hooks
 
 import (
+	"broker-manager/services"
 	"broker-manager/websockets"
 	"bytes"
 	mqtt "github.com/mochi-mqtt/server/v2"
@@ -17,6 +18,9 @@ type ClientConnectedEvent struct {
 	QoS       uint8  `json:"qos"`
 	KeepAlive uint16 `json:"keep_alive"`
 	Timestamp uint64 `json:"timestamp"`
+
+	CertificateFingerprint string `json:"certificate_fingerprint,omitempty"`
+	CertificateSubject     string `json:"certificate_subject,omitempty"`
 }
 
 // OnConnect intercepts new connections
@@ -48,7 +52,13 @@ func (h *OnConnect) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
 		Timestamp:       uint64(time.Now().UnixMilli()),
 	}
 
+	if certificate := services.ClientCertificate(cl.Net.Conn); certificate != nil {
+		identity := services.NewCertificateIdentity(certificate)
+		event.CertificateFingerprint = identity.Fingerprint
+		event.CertificateSubject = identity.Subject
+	}
+
 	h.Log.Info("New connection", "event", event)
-	websockets.SendMessage(websockets.MqttClientConnected, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttClientConnected, event)
 	return nil
 }
@@ -1,14 +1,17 @@
 package hooks
 
 import (
+	"broker-manager/services"
 	"broker-manager/websockets"
 	"bytes"
+	"errors"
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"time"
 )
 
 type ClientDisconnectedEvent struct {
 	ID        string `json:"id"`
+	Reason    string `json:"reason,omitempty"` // Set to "revoked" when the client was kicked because its credentials were revoked
 	Timestamp uint64 `json:"timestamp"`
 }
 
@@ -35,6 +38,10 @@ func (h *OnDisconnect) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
 		Timestamp: uint64(time.Now().UnixMilli()),
 	}
 
+	if errors.Is(cl.StopCause(), services.ErrRevoked) {
+		event.Reason = "revoked"
+	}
+
 	h.Log.Info("Client Disconnected", "event", event)
-	websockets.SendMessage(websockets.MqttClientDisconnected, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttClientDisconnected, event)
 }
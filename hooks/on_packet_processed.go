@@ -63,7 +63,7 @@ func (h *OnPacketProcessed) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b [
 	}
 
 	h.Log.Info("Packet Processed", "event", event)
-	websockets.SendMessage(websockets.MqttPacketProcessed, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttPacketProcessed, event)
 }
 
 // OnPacketProcessed Intercepts the disconnected client and generates an event to be sent on the websocket
@@ -77,5 +77,5 @@ func (h *OnPacketProcessed) OnPacketProcessed(cl *mqtt.Client, pk packets.Packet
 	}
 
 	h.Log.Info("Packet Processed", "event", event)
-	websockets.SendMessage(websockets.MqttPacketProcessed, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttPacketProcessed, event)
 }
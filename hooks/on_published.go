@@ -9,12 +9,13 @@ import (
 )
 
 type ClientPublishedEvent struct {
-	ID        string `json:"id"`
-	TopicName string `json:"topic_name"`
-	Payload   string `json:"payload"`
-	QoS       uint8  `json:"qos"`
-	Retain    bool   `json:"retain"`
-	Timestamp uint64 `json:"timestamp"`
+	ID                string `json:"id"`
+	TopicName         string `json:"topic_name"`
+	InternalTopicName string `json:"internal_topic_name"`
+	Payload           string `json:"payload"`
+	QoS               uint8  `json:"qos"`
+	Retain            bool   `json:"retain"`
+	Timestamp         uint64 `json:"timestamp"`
 }
 
 type OnPublished struct {
@@ -36,14 +37,15 @@ func (h *OnPublished) Provides(b byte) bool {
 // OnPublished Intercepts the disconnected client and generates an event to be sent on the websocket
 func (h *OnPublished) OnPublished(cl *mqtt.Client, pk packets.Packet) {
 	event := ClientPublishedEvent{
-		ID:        cl.ID,
-		TopicName: pk.TopicName,
-		Payload:   string(pk.Payload),
-		QoS:       pk.FixedHeader.Qos,
-		Retain:    pk.FixedHeader.Retain,
-		Timestamp: uint64(time.Now().UnixMilli()),
+		ID:                cl.ID,
+		TopicName:         clientTopic(cl, pk.TopicName),
+		InternalTopicName: pk.TopicName,
+		Payload:           string(pk.Payload),
+		QoS:               pk.FixedHeader.Qos,
+		Retain:            pk.FixedHeader.Retain,
+		Timestamp:         uint64(time.Now().UnixMilli()),
 	}
 
 	h.Log.Info("Client published", "event", event)
-	websockets.SendMessage(websockets.MqttClientPublished, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttClientPublished, event)
 }
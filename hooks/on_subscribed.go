@@ -9,10 +9,11 @@ import (
 )
 
 type ClientSubscribedEvent struct {
-	ID        string `json:"id"`
-	TopicName string `json:"topic_name"`
-	QoS       uint8  `json:"qos"`
-	Timestamp uint64 `json:"timestamp"`
+	ID                string `json:"id"`
+	TopicName         string `json:"topic_name"`
+	InternalTopicName string `json:"internal_topic_name"`
+	QoS               uint8  `json:"qos"`
+	Timestamp         uint64 `json:"timestamp"`
 }
 
 type OnSubscribed struct {
@@ -39,12 +40,13 @@ func (h *OnSubscribed) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCo
 
 	filter := pk.Filters[0]
 	event := ClientSubscribedEvent{
-		ID:        cl.ID,
-		TopicName: filter.Filter,
-		QoS:       filter.Qos,
-		Timestamp: uint64(time.Now().UnixMilli()),
+		ID:                cl.ID,
+		TopicName:         clientTopic(cl, filter.Filter),
+		InternalTopicName: filter.Filter,
+		QoS:               filter.Qos,
+		Timestamp:         uint64(time.Now().UnixMilli()),
 	}
 
 	h.Log.Info("Client subscribed to a topic", "event", event)
-	websockets.SendMessage(websockets.MqttClientSubscribed, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttClientSubscribed, event)
 }
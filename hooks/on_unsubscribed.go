@@ -9,9 +9,10 @@ import (
 )
 
 type ClientUnsubscribedEvent struct {
-	ID        string `json:"id"`
-	TopicName string `json:"topic_name"`
-	Timestamp uint64 `json:"timestamp"`
+	ID                string `json:"id"`
+	TopicName         string `json:"topic_name"`
+	InternalTopicName string `json:"internal_topic_name"`
+	Timestamp         uint64 `json:"timestamp"`
 }
 
 type OnUnsubscribed struct {
@@ -38,11 +39,12 @@ func (h *OnUnsubscribed) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
 
 	filter := pk.Filters[0]
 	event := ClientUnsubscribedEvent{
-		ID:        cl.ID,
-		TopicName: filter.Filter,
-		Timestamp: uint64(time.Now().UnixMilli()),
+		ID:                cl.ID,
+		TopicName:         clientTopic(cl, filter.Filter),
+		InternalTopicName: filter.Filter,
+		Timestamp:         uint64(time.Now().UnixMilli()),
 	}
 
 	h.Log.Info("Client unsubscribed from a topic", "event", event)
-	websockets.SendMessage(websockets.MqttClientUnsubscribed, event)
+	websockets.SendTeamMessage(clientTeam(cl), websockets.MqttClientUnsubscribed, event)
 }
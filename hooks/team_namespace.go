@@ -0,0 +1,130 @@
+package hooks
+
+import (
+	"broker-manager/services"
+	"bytes"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// TeamNamespace transparently mounts every client's topics under its team prefix
+type TeamNamespace struct {
+	mqtt.HookBase
+}
+
+// ID returns the ID of the hook.
+func (h *TeamNamespace) ID() string {
+	return "team-namespace"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *TeamNamespace) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnSubscribe,
+		mqtt.OnUnsubscribe,
+		mqtt.OnWill,
+		mqtt.OnPacketEncode,
+	}, []byte{b})
+}
+
+// OnPublish mounts the topic of an incoming message under the publisher's team. Messages of clients without a
+// known team are dropped, as they cannot be kept inside a namespace.
+func (h *TeamNamespace) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline || pk.TopicName == "" || !services.NamespaceEnabled() {
+		return pk, nil
+	}
+
+	token := clientToken(cl)
+	if token == nil {
+		h.Log.Info("Dropping message of client without team", "client", cl.ID, "topic", pk.TopicName)
+		return pk, packets.ErrRejectPacket
+	}
+
+	pk.TopicName = token.MountTopic(pk.TopicName)
+	return pk, nil
+}
+
+// OnSubscribe mounts the requested filters under the subscriber's team
+func (h *TeamNamespace) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	return h.mountFilters(cl, pk)
+}
+
+// OnUnsubscribe mounts the filters being removed under the subscriber's team
+func (h *TeamNamespace) OnUnsubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	return h.mountFilters(cl, pk)
+}
+
+// OnWill mounts the topic of the client's last will under its team. The wills of clients without a known team
+// are dropped by clearing them, as mochi only logs errors returned by OnWill.
+func (h *TeamNamespace) OnWill(cl *mqtt.Client, will mqtt.Will) (mqtt.Will, error) {
+	// Wills dropped by an earlier hook have no topic and stay dropped.
+	if will.TopicName == "" || !services.NamespaceEnabled() {
+		return will, nil
+	}
+
+	token := clientToken(cl)
+	if token == nil {
+		h.Log.Info("Dropping last will of client without team", "client", cl.ID, "topic", will.TopicName)
+		return mqtt.Will{}, nil
+	}
+
+	will.TopicName = token.MountTopic(will.TopicName)
+	return will, nil
+}
+
+// OnPacketEncode strips the team prefix from messages delivered to a client
+func (h *TeamNamespace) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type != packets.Publish || pk.TopicName == "" {
+		return pk
+	}
+
+	pk.TopicName, _ = clientToken(cl).UnmountTopic(pk.TopicName)
+	return pk
+}
+
+// mountFilters rewrites every filter of a (un)subscribe packet. The filters slice is copied, as it may be shared.
+func (h *TeamNamespace) mountFilters(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if cl.Net.Inline || !services.NamespaceEnabled() {
+		return pk
+	}
+
+	token := clientToken(cl)
+	filters := make(packets.Subscriptions, len(pk.Filters))
+	for i, filter := range pk.Filters {
+		filter.Filter = token.MountTopic(filter.Filter)
+		filters[i] = filter
+	}
+
+	pk.Filters = filters
+	return pk
+}
+
+// clientToken returns the cached authentication token of the client, used to resolve its team, or the token it
+// connected with once the cached one was revoked, evicted or expired
+func clientToken(cl *mqtt.Client) *services.AuthenticatedToken {
+	if token := services.AuthServiceInstance.Lookup(cl.ID, string(cl.Properties.Username)); token != nil {
+		return token
+	}
+
+	if token, ok := connectedTokens.Load(cl); ok {
+		return token.(*services.AuthenticatedToken)
+	}
+
+	return nil
+}
+
+// clientTeam returns the team ID of the client, 0 if it has no known authentication token
+func clientTeam(cl *mqtt.Client) uint64 {
+	if token := clientToken(cl); token != nil {
+		return token.TeamID
+	}
+
+	return 0
+}
+
+// clientTopic returns the topic as seen by the client, given the internal topic used by the broker
+func clientTopic(cl *mqtt.Client, topic string) string {
+	visible, _ := clientToken(cl).UnmountTopic(topic)
+	return visible
+}
@@ -0,0 +1,385 @@
+package hooks
+
+import (
+	"broker-manager/services"
+	"broker-manager/websockets"
+	"bytes"
+	"context"
+	"flag"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Define flags for quota usage reports.
+var (
+	quotaUsageInterval = flag.Duration("quota-usage-interval", time.Minute, "Interval for sending the quota usage of every team to the panel")
+)
+
+// TeamQuotaUsageEvent reports the resources a team used, sent periodically for every active team.
+type TeamQuotaUsageEvent struct {
+	TeamID        uint64               `json:"team_id"`
+	Connections   int                  `json:"connections"`
+	Subscriptions int                  `json:"subscriptions"`
+	Messages      uint64               `json:"messages"`    // Messages published since the previous report
+	BytesToday    int64                `json:"bytes_today"` // Payload bytes published in the current UTC day
+	Rejected      uint64               `json:"rejected"`    // Connections, subscriptions and messages refused since the previous report
+	Quotas        *services.TeamQuotas `json:"quotas"`
+	Timestamp     uint64               `json:"timestamp"`
+}
+
+// TeamQuotaOptions contains the configuration of the TeamQuota hook.
+type TeamQuotaOptions struct {
+	Server *mqtt.Server // Server the quotas are enforced on
+}
+
+// teamUsage is the resource usage of a team.
+type teamUsage struct {
+	quotas   *services.TeamQuotas // Quotas of the most recently connected client's token
+	clients  map[*mqtt.Client]bool
+	tokens   float64 // Remaining messages of the rate limiter bucket
+	refilled time.Time
+	day      string // UTC day bytes are counted for
+	bytes    int64
+	messages uint64
+	rejected uint64
+}
+
+// rejectedSubscriptions are the filters of a SUBSCRIBE packet refused because of the subscription quota.
+type rejectedSubscriptions struct {
+	packetID uint16
+	indexes  []int
+	filters  map[string]bool
+}
+
+// TeamQuota enforces the connection, subscription, message rate and daily traffic quotas of every team and
+// periodically reports their usage to the panel.
+type TeamQuota struct {
+	mqtt.HookBase
+	server   *mqtt.Server
+	mutex    sync.Mutex
+	teams    map[uint64]*teamUsage
+	rejected sync.Map // Subscriptions refused by OnSubscribe by client, until the SUBACK is sent
+	stop     context.CancelFunc
+}
+
+// ID returns the ID of the hook.
+func (h *TeamQuota) ID() string {
+	return "team-quota"
+}
+
+// Init configures the hook with the server it enforces the quotas on.
+func (h *TeamQuota) Init(config any) error {
+	options, ok := config.(*TeamQuotaOptions)
+	if !ok || options == nil || options.Server == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.server = options.Server
+	h.teams = make(map[uint64]*teamUsage)
+	return nil
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *TeamQuota) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribe,
+		mqtt.OnPublish,
+		mqtt.OnPacketEncode,
+	}, []byte{b})
+}
+
+// OnStarted starts the periodic usage reports.
+func (h *TeamQuota) OnStarted() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.stop = cancel
+
+	go func() {
+		ticker := time.NewTicker(*quotaUsageInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.reportUsage()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// OnStopped stops the usage reports.
+func (h *TeamQuota) OnStopped() {
+	if h.stop != nil {
+		h.stop()
+	}
+}
+
+// AdmitConnection registers an authenticated client with its team, or returns quota exceeded if the team already
+// has as many clients connected as its quota allows. It is called by the authentication hooks once the client's
+// token is cached, before they keep any state of the connection.
+func (h *TeamQuota) AdmitConnection(cl *mqtt.Client) error {
+	token := clientToken(cl)
+	if token == nil {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	team := h.team(token.TeamID)
+	team.quotas = token.Quotas()
+
+	connected := 0
+	for other := range team.clients {
+		// A client taking over the session of its previous connection replaces it.
+		if other.ID != cl.ID && !other.Closed() {
+			connected++
+		}
+	}
+
+	if team.quotas != nil && team.quotas.MaxConnections > 0 && connected >= team.quotas.MaxConnections {
+		team.rejected++
+		h.Log.Info("Connection quota exceeded", "client", cl.ID, "team", token.TeamID)
+		return packets.ErrQuotaExceeded
+	}
+
+	team.clients[cl] = true
+	return nil
+}
+
+// OnDisconnect releases the connection of the client.
+func (h *TeamQuota) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.rejected.Delete(cl)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, team := range h.teams {
+		delete(team.clients, cl)
+	}
+}
+
+// OnSubscribe refuses the new filters exceeding the team's subscription quota. They are denied by the ACL
+// check and their SUBACK reason code is rewritten to quota exceeded in OnPacketEncode.
+func (h *TeamQuota) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	// Refusals only apply to the SUBSCRIBE packet they were made for.
+	h.rejected.Delete(cl)
+	if cl.Net.Inline {
+		return pk
+	}
+
+	token := clientToken(cl)
+	quotas := token.Quotas()
+	if quotas == nil || quotas.MaxSubscriptions <= 0 {
+		return pk
+	}
+
+	subscriptions := h.subscriptions(token.TeamID)
+	rejected := rejectedSubscriptions{packetID: pk.PacketID, filters: make(map[string]bool)}
+	for i, filter := range pk.Filters {
+		// Replacing an existing subscription does not use more of the quota.
+		if _, exists := cl.State.Subscriptions.Get(filter.Filter); exists {
+			continue
+		}
+
+		if subscriptions >= quotas.MaxSubscriptions {
+			rejected.indexes = append(rejected.indexes, i)
+			rejected.filters[filter.Filter] = true
+			continue
+		}
+
+		subscriptions++
+	}
+
+	if len(rejected.indexes) > 0 {
+		h.Log.Info("Subscription quota exceeded", "client", cl.ID, "filters", len(rejected.indexes))
+		h.rejected.Store(cl, rejected)
+		h.count(token.TeamID, func(team *teamUsage) { team.rejected += uint64(len(rejected.indexes)) })
+	}
+
+	return pk
+}
+
+// RejectsSubscription reports whether OnSubscribe refused the filter of the SUBSCRIBE packet the client is sending.
+// Refusals are forgotten once the SUBACK of that packet is encoded.
+func (h *TeamQuota) RejectsSubscription(cl *mqtt.Client, filter string) bool {
+	rejected, ok := h.rejected.Load(cl)
+	return ok && rejected.(rejectedSubscriptions).filters[filter]
+}
+
+// OnPublish refuses messages exceeding the team's message rate or daily traffic. MQTT v5 clients publishing
+// with QoS 1 receive a PUBACK and with QoS 2 a PUBREC with quota exceeded, other messages are dropped.
+func (h *TeamQuota) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	token := clientToken(cl)
+	if cl.Net.Inline || token == nil {
+		return pk, nil
+	}
+
+	allowed := true
+	quotas := token.Quotas()
+	h.count(token.TeamID, func(team *teamUsage) {
+		now := time.Now()
+		if day := now.UTC().Format(time.DateOnly); day != team.day {
+			team.day = day
+			team.bytes = 0
+		}
+
+		if quotas != nil && quotas.MessagesPerSecond > 0 {
+			// The bucket holds one second worth of messages, and is full on the team's first message.
+			burst := max(quotas.MessagesPerSecond, 1)
+			team.tokens = min(team.tokens+now.Sub(team.refilled).Seconds()*quotas.MessagesPerSecond, burst)
+			team.refilled = now
+			allowed = team.tokens >= 1
+		}
+
+		if quotas != nil && quotas.BytesPerDay > 0 && team.bytes+int64(len(pk.Payload)) > quotas.BytesPerDay {
+			allowed = false
+		}
+
+		if !allowed {
+			team.rejected++
+			return
+		}
+
+		team.tokens--
+		team.bytes += int64(len(pk.Payload))
+		team.messages++
+	})
+
+	if allowed {
+		return pk, nil
+	}
+
+	if cl.Properties.ProtocolVersion < 5 {
+		return pk, packets.ErrRejectPacket
+	}
+
+	switch pk.FixedHeader.Qos {
+	case 1:
+		// The server answers reason codes returned for QoS 1 messages with a PUBACK.
+		return pk, packets.ErrQuotaExceeded
+	case 2:
+		// A PUBREC with an error reason code ends the QoS 2 flow, the client does not send a PUBREL.
+		err := cl.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Pubrec},
+			PacketID:    pk.PacketID,
+			ReasonCode:  packets.ErrQuotaExceeded.Code,
+		})
+		if err != nil {
+			h.Log.Warn("Refusing message failed", "client", cl.ID, "error", err)
+		}
+	}
+
+	return pk, packets.ErrRejectPacket
+}
+
+// OnPacketEncode forgets the subscriptions refused by OnSubscribe once their SUBACK is sent, and sets their
+// reason code to quota exceeded for MQTT v5 clients.
+func (h *TeamQuota) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type != packets.Suback {
+		return pk
+	}
+
+	value, ok := h.rejected.Load(cl)
+	if !ok || value.(rejectedSubscriptions).packetID != pk.PacketID {
+		return pk
+	}
+	h.rejected.Delete(cl)
+
+	if cl.Properties.ProtocolVersion < 5 {
+		return pk
+	}
+
+	pk.ReasonCodes = slices.Clone(pk.ReasonCodes)
+	for _, i := range value.(rejectedSubscriptions).indexes {
+		if i < len(pk.ReasonCodes) && pk.ReasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			pk.ReasonCodes[i] = packets.ErrQuotaExceeded.Code
+		}
+	}
+
+	return pk
+}
+
+// subscriptions returns the number of subscriptions of the team's connected clients.
+func (h *TeamQuota) subscriptions(teamID uint64) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	subscriptions := 0
+	for cl := range h.team(teamID).clients {
+		subscriptions += cl.State.Subscriptions.Len()
+	}
+
+	return subscriptions
+}
+
+// count updates the usage of a team.
+func (h *TeamQuota) count(teamID uint64, fn func(team *teamUsage)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fn(h.team(teamID))
+}
+
+// team returns the usage of a team, creating it if needed. The caller must hold the lock.
+func (h *TeamQuota) team(teamID uint64) *teamUsage {
+	team := h.teams[teamID]
+	if team == nil {
+		team = &teamUsage{clients: make(map[*mqtt.Client]bool)}
+		h.teams[teamID] = team
+	}
+
+	return team
+}
+
+// reportUsage sends the usage of every active team to the panel and forgets teams without clients or traffic.
+func (h *TeamQuota) reportUsage() {
+	h.mutex.Lock()
+	events := make([]TeamQuotaUsageEvent, 0, len(h.teams))
+	for teamID, team := range h.teams {
+		// Clients whose connection failed after OnConnect never reach OnDisconnect.
+		for cl := range team.clients {
+			if cl.Closed() {
+				delete(team.clients, cl)
+			}
+		}
+
+		if len(team.clients) == 0 && team.messages == 0 && team.rejected == 0 {
+			if team.day != time.Now().UTC().Format(time.DateOnly) {
+				delete(h.teams, teamID)
+			}
+			continue
+		}
+
+		event := TeamQuotaUsageEvent{
+			TeamID:      teamID,
+			Connections: len(team.clients),
+			Messages:    team.messages,
+			BytesToday:  team.bytes,
+			Rejected:    team.rejected,
+			Quotas:      team.quotas,
+			Timestamp:   uint64(time.Now().UnixMilli()),
+		}
+		for cl := range team.clients {
+			event.Subscriptions += cl.State.Subscriptions.Len()
+		}
+
+		team.messages = 0
+		team.rejected = 0
+		events = append(events, event)
+	}
+	h.mutex.Unlock()
+
+	for _, event := range events {
+		h.Log.Info("Team quota usage", "event", event)
+		websockets.SendTeamMessage(event.TeamID, websockets.MqttTeamQuotaUsage, event)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"broker-manager/admin"
 	"broker-manager/auth"
 	"broker-manager/hooks"
 	"broker-manager/services"
 	"broker-manager/websockets"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/listeners"
@@ -16,12 +21,36 @@ import (
 
 var server *mqtt.Server
 
+// Define flags for the listeners.
+var (
+	tcpAddr  = flag.String("tcp", ":1883", "network address for TCP listener")
+	wsAddr   = flag.String("ws", ":1882", "network address for Websocket listener")
+	infoAddr = flag.String("info", ":8080", "network address for web info dashboard listener")
+
+	tlsTcpAddr      = flag.String("tls-tcp", ":8883", "network address for TLS TCP listener, enabled when a certificate is set")
+	tlsWsAddr       = flag.String("tls-ws", ":8884", "network address for secure Websocket listener, enabled when a certificate is set")
+	tlsCertFile     = flag.String("tls-cert", "", "PEM certificate of the TLS listeners")
+	tlsKeyFile      = flag.String("tls-key", "", "PEM private key of the TLS listeners")
+	tlsClientCAFile = flag.String("tls-client-ca", "", "PEM CA bundle client certificates are verified against, empty to not request them")
+	tlsRequireCert  = flag.Bool("tls-require-client-cert", false, "Reject TLS clients that do not present a valid client certificate")
+)
+
 func main() {
+	// The auth subcommand manages a running broker through its admin API.
+	if len(os.Args) > 1 && os.Args[1] == "auth" {
+		os.Exit(admin.RunCLI(os.Args[2:]))
+	}
+
 	websockets.Init()
-	services.AuthServiceInit()
+	authService, err := services.AuthServiceInit()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	//goland:noinspection GoUnhandledErrorResult
 	defer websockets.Close()
+	//goland:noinspection GoUnhandledErrorResult
+	defer authService.Close()
 
 	// Create signals channel to run server until interrupted
 	sigs := make(chan os.Signal, 1)
@@ -35,8 +64,9 @@ func main() {
 	// Create the new MQTT Server.
 	server = mqtt.New(nil)
 
-	setupHooks()
+	customAuth := setupHooks(authService)
 	setupListeners()
+	setupAdmin(customAuth, authService)
 
 	// Start Server
 	go func() {
@@ -55,9 +85,40 @@ func main() {
 	server.Log.Info("mochi mqtt shutdown complete")
 }
 
-func setupHooks() {
-	// Allow all connections. ToDo setup authentication
-	_ = server.AddHook(new(auth.CustomAuth), nil)
+func setupHooks(authService *services.AuthService) *auth.CustomAuth {
+	// Authenticate connections and authorize topics through the auth service
+	guard := services.NewLoginGuard()
+	teamQuota := new(hooks.TeamQuota)
+	customAuth := new(auth.CustomAuth)
+	if err := server.AddHook(customAuth, &auth.CustomAuthOptions{
+		Server:  server,
+		Service: authService,
+		Guard:   guard,
+		Limiter: teamQuota,
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Authenticate MQTT v5 clients with SCRAM-SHA-256 AUTH exchanges when enabled
+	if services.ScramEnabled() {
+		if err := server.AddHook(new(auth.ScramAuth), &auth.ScramAuthOptions{
+			Server:  server,
+			Service: authService,
+			Guard:   guard,
+			Limiter: teamQuota,
+		}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Mount client topics under their team prefix when tenancy is enabled
+	_ = server.AddHook(new(hooks.TeamNamespace), nil)
+
+	// Enforce team quotas on authenticated clients and their mounted topics, connections are admitted by the
+	// authentication hooks
+	if err := server.AddHook(teamQuota, &hooks.TeamQuotaOptions{Server: server}); err != nil {
+		log.Fatal(err)
+	}
 
 	// Setup intercept hooks
 	_ = server.AddHook(new(hooks.OnConnect), nil)
@@ -67,12 +128,33 @@ func setupHooks() {
 	_ = server.AddHook(new(hooks.OnPublished), nil)
 
 	_ = server.AddHook(new(hooks.OnPacketProcessed), nil)
+
+	// Keep the team of connected clients known after their token is gone, forgetting it after every other hook
+	_ = server.AddHook(new(hooks.ClientTeams), nil)
+
+	return customAuth
+}
+
+// setupAdmin serves the admin API and accepts credential revocations as commands over the Reverb connection.
+func setupAdmin(customAuth *auth.CustomAuth, authService *services.AuthService) {
+	if err := admin.Serve(customAuth, authService); err != nil {
+		log.Fatal(err)
+	}
+
+	websockets.Handle(websockets.MqttRevokeCredentials, func(data json.RawMessage) {
+		var filter services.RevocationFilter
+		if err := json.Unmarshal(data, &filter); err != nil {
+			log.Println("revoke:", err)
+			return
+		}
+
+		if _, _, err := customAuth.Revoke(filter); err != nil {
+			log.Println("revoke:", err)
+		}
+	})
 }
 
 func setupListeners() {
-	tcpAddr := flag.String("tcp", ":1883", "network address for TCP listener")
-	wsAddr := flag.String("ws", ":1882", "network address for Websocket listener")
-	infoAddr := flag.String("info", ":8080", "network address for web info dashboard listener")
 	flag.Parse()
 
 	// Create a TCP listener on a standard port.
@@ -107,4 +189,77 @@ func setupListeners() {
 	if err := server.AddListener(stats); err != nil {
 		log.Fatal(err)
 	}
+
+	setupTLSListeners()
+}
+
+// setupTLSListeners creates the TLS TCP and secure Websocket listeners if a certificate is configured.
+func setupTLSListeners() {
+	if *tlsCertFile == "" || *tlsKeyFile == "" {
+		return
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create a TLS TCP listener on the secure MQTT port.
+	tlsTcp := listeners.NewTCP(listeners.Config{
+		ID:        "tls1",
+		Address:   *tlsTcpAddr,
+		TLSConfig: tlsConfig,
+	})
+
+	// Create secure WebSocket Listener
+	tlsWs := listeners.NewWebsocket(listeners.Config{
+		ID:        "wss1",
+		Address:   *tlsWsAddr,
+		TLSConfig: tlsConfig,
+	})
+
+	// Listen to tls
+	if err := server.AddListener(tlsTcp); err != nil {
+		log.Fatal(err)
+	}
+
+	// Listen to wss
+	if err := server.AddListener(tlsWs); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newTLSConfig loads the server certificate and, if configured, the CA bundle used to verify client certificates.
+func newTLSConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if *tlsClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	bundle, err := os.ReadFile(*tlsClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in " + *tlsClientCAFile)
+	}
+
+	// Clients without a certificate may still authenticate with a password unless certificates are required.
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if *tlsRequireCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
 }
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"flag"
+	"strings"
+)
+
+// Define flags for the ACL behaviour.
+var (
+	aclDefaultAllow = flag.Bool("acl-default-allow", false, "Allow every topic for tokens whose auth response carries no topic filters")
+)
+
+// Reasons of denied topic accesses.
+var (
+	ErrNotAuthenticated = errors.New("client is not authenticated")
+	ErrOutsideNamespace = errors.New("topic is outside the team namespace")
+	ErrTopicDenied      = errors.New("topic is denied by the ACL policy")
+	ErrTopicNotAllowed  = errors.New("topic is not allowed")
+)
+
+// TopicPermissions lists the MQTT topic filters a token is allowed to publish and subscribe to.
+type TopicPermissions struct {
+	Publish   []string `json:"publish" yaml:"publish"`     // Filters the client may publish to
+	Subscribe []string `json:"subscribe" yaml:"subscribe"` // Filters the client may subscribe to or receive from
+}
+
+// Allows reports whether the topic (or subscription filter) is covered by the filters of the given direction.
+func (p *TopicPermissions) Allows(topic string, write bool) bool {
+	// Tokens issued without any permissions fall back to the configured default.
+	if p == nil {
+		return *aclDefaultAllow
+	}
+
+	filters := p.Subscribe
+	if write {
+		filters = p.Publish
+	}
+
+	// Shared subscriptions are authorized against the filter they share.
+	_, topic = splitShared(topic)
+
+	for _, filter := range filters {
+		if MatchFilter(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchFilter reports whether the allowed filter covers the requested topic name or subscription filter.
+// Wildcards in the requested value are only accepted when the allowed filter is at least as broad.
+func MatchFilter(allowed, requested string) bool {
+	allowedLevels := strings.Split(allowed, "/")
+	requestedLevels := strings.Split(requested, "/")
+
+	// Wildcards at the first level must not match topics reserved by the broker, e.g. $SYS.
+	if strings.HasPrefix(requested, "$") && !strings.HasPrefix(allowed, "$") {
+		return false
+	}
+
+	for i, level := range allowedLevels {
+		if level == "#" {
+			return true // Multi-level wildcard covers everything below, including the parent level.
+		}
+
+		if i >= len(requestedLevels) {
+			return false
+		}
+
+		switch requestedLevels[i] {
+		case "#":
+			return false // Requested multi-level wildcard is broader than the allowed level.
+		case "+":
+			if level != "+" {
+				return false // Requested single-level wildcard is broader than a literal level.
+			}
+		default:
+			if level != "+" && level != requestedLevels[i] {
+				return false
+			}
+		}
+	}
+
+	return len(allowedLevels) == len(requestedLevels)
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"flag"
+	"sync"
+)
+
+// Define flags for the ACL decision cache.
+var (
+	aclCacheSize = flag.Int("acl-cache-size", 256, "Maximum number of ACL decisions cached per client, 0 disables the cache")
+)
+
+// aclQuery identifies an ACL decision of a client.
+type aclQuery struct {
+	topic string
+	write bool
+}
+
+// aclDecisions are the cached ACL decisions of a client, valid as long as its token is unchanged.
+type aclDecisions struct {
+	sync.Mutex
+	token     *AuthenticatedToken // Token the decisions were made for
+	decisions map[aclQuery]error  // Decisions by topic and direction, nil when allowed
+}
+
+// aclCache caches the ACL decisions of clients by authentication key. Decisions made for another token than
+// the client's current one are discarded, so re-authentications, evictions and revocations take effect at once.
+type aclCache struct {
+	clients sync.Map // *aclDecisions by authentication key
+}
+
+// get returns the cached decision of the client with the token for the topic and direction.
+func (c *aclCache) get(authKey string, token *AuthenticatedToken, query aclQuery) (error, bool) {
+	value, ok := c.clients.Load(authKey)
+	if !ok {
+		return nil, false
+	}
+
+	entry := value.(*aclDecisions)
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.token != token {
+		return nil, false
+	}
+
+	decision, ok := entry.decisions[query]
+	return decision, ok
+}
+
+// put caches a decision of the client with the token, dropping those made for a previous token. A full
+// cache is cleared instead of evicting single decisions.
+func (c *aclCache) put(authKey string, token *AuthenticatedToken, query aclQuery, decision error) {
+	if *aclCacheSize <= 0 {
+		return
+	}
+
+	value, _ := c.clients.LoadOrStore(authKey, &aclDecisions{})
+	entry := value.(*aclDecisions)
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.token != token || len(entry.decisions) >= *aclCacheSize {
+		entry.token = token
+		entry.decisions = make(map[aclQuery]error)
+	}
+
+	entry.decisions[query] = decision
+}
+
+// delete removes the decisions of the client.
+func (c *aclCache) delete(authKey string) {
+	c.clients.Delete(authKey)
+}
+
+// sweep removes the decisions of clients whose token is no longer stored.
+func (c *aclCache) sweep(store *TokenStore) {
+	c.clients.Range(func(key, value any) bool {
+		entry := value.(*aclDecisions)
+		entry.Lock()
+		token := entry.token
+		entry.Unlock()
+
+		if store.Get(key.(string)) != token {
+			c.clients.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// Define flags for the ACL policy templates.
+var (
+	aclPolicyFile = flag.String("acl-policy-file", "", "YAML or JSON file with read and write ACL rule templates applied to every client")
+)
+
+// ACLRules are the topic filter templates of one direction. Deny rules override allow rules.
+type ACLRules struct {
+	Allow []string `yaml:"allow"` // Filters the client may use
+	Deny  []string `yaml:"deny"`  // Filters the client may never use, whatever else allows them
+}
+
+// ACLPolicy holds the rule templates applied to every client. Templates may contain the placeholders
+// {client_id}, {username}, {team_id} and {mqtt_client_id}.
+type ACLPolicy struct {
+	Read  ACLRules `yaml:"read"`  // Rules for subscriptions and deliveries
+	Write ACLRules `yaml:"write"` // Rules for publishes
+}
+
+// aclPlaceholders are the placeholders supported by the policy templates.
+var aclPlaceholders = []string{"{client_id}", "{username}", "{team_id}", "{mqtt_client_id}"}
+
+// configuredPolicy holds the loaded ACL policy file, empty if none is configured.
+var configuredPolicy ACLPolicy
+
+// loadACLPolicy reads the ACL policy file, if configured.
+func loadACLPolicy() error {
+	if *aclPolicyFile == "" {
+		return nil
+	}
+
+	return loadConfigFile(*aclPolicyFile, &configuredPolicy)
+}
+
+// Authorizes evaluates the client's access to the topic in the requested direction and returns the reason of a
+// denial. A matching deny rule of the policy refuses the topic, otherwise a matching allow rule of the policy or
+// of the token's permissions accepts it.
+func (t *AuthenticatedToken) Authorizes(clientId, username, topic string, write bool) error {
+	rules := configuredPolicy.Read
+	if write {
+		rules = configuredPolicy.Write
+	}
+
+	// Shared subscriptions are authorized against the filter they share.
+	_, filter := splitShared(topic)
+
+	values := t.placeholders(clientId, username)
+	for _, template := range rules.Deny {
+		denied, ok := expandTemplate(template, values)
+		if !ok || MatchFilter(denied, filter) {
+			return ErrTopicDenied // Deny rules that cannot be expanded fail closed.
+		}
+	}
+
+	for _, template := range rules.Allow {
+		allowed, ok := expandTemplate(template, values)
+		if ok && MatchFilter(allowed, filter) {
+			return nil
+		}
+	}
+
+	if !t.Permissions.Allows(topic, write) {
+		return ErrTopicNotAllowed
+	}
+
+	return nil
+}
+
+// placeholders returns the values substituted into the policy templates for the client. Values that could
+// widen a filter, i.e. empty ones, unset IDs and those containing a level separator or wildcard, are left out.
+func (t *AuthenticatedToken) placeholders(clientId, username string) map[string]string {
+	candidates := []string{clientId, username, idPlaceholder(t.TeamID), idPlaceholder(t.MqttClientID)}
+
+	values := make(map[string]string, len(aclPlaceholders))
+	for i, placeholder := range aclPlaceholders {
+		if value := candidates[i]; value != "" && !strings.ContainsAny(value, "/+#") {
+			values[placeholder] = value
+		}
+	}
+
+	return values
+}
+
+// idPlaceholder formats an ID for a template, or returns an empty string for an unset ID.
+func idPlaceholder(id uint64) string {
+	if id == 0 {
+		return ""
+	}
+
+	return strconv.FormatUint(id, 10)
+}
+
+// expandTemplate substitutes the placeholders of a rule template. It returns false if the template uses a
+// placeholder without a value.
+func expandTemplate(template string, values map[string]string) (string, bool) {
+	replacements := make([]string, 0, 2*len(values))
+	for _, placeholder := range aclPlaceholders {
+		value, ok := values[placeholder]
+		if !ok {
+			if strings.Contains(template, placeholder) {
+				return "", false
+			}
+			continue
+		}
+
+		replacements = append(replacements, placeholder, value)
+	}
+
+	// A single pass keeps placeholders inside substituted values from being expanded again.
+	return strings.NewReplacer(replacements...).Replace(template), true
+}
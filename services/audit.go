@@ -0,0 +1,150 @@
+package services
+
+import (
+	"broker-manager/websockets"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Define flags for the access audit log.
+var (
+	auditLogFile     = flag.String("audit-log-file", "", "File denied connects, subscriptions and publishes are appended to as JSON lines, empty to disable it")
+	auditLogMaxSize  = flag.Int64("audit-log-max-size", 10<<20, "Size in bytes at which the audit log file is rotated")
+	auditLogMaxFiles = flag.Int("audit-log-max-files", 5, "Number of rotated audit log files kept besides the current one")
+)
+
+// Directions of an audited access.
+const (
+	DirectionConnect = "connect" // Connection attempt
+	DirectionRead    = "read"    // Subscription or delivery
+	DirectionWrite   = "write"   // Publish
+)
+
+// AccessDeniedEvent reports a denied connect, subscription or publish.
+type AccessDeniedEvent struct {
+	ClientID  string `json:"client_id"`
+	Username  string `json:"username"`
+	TeamID    uint64 `json:"team_id"` // Team of the client's token, 0 if it has none
+	Remote    string `json:"remote"`
+	Direction string `json:"direction"`       // connect, read or write
+	Topic     string `json:"topic,omitempty"` // Client-visible topic or filter, empty for connects
+	Reason    string `json:"reason"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// AuditLog appends events as JSON lines to a file, rotating it once it reaches its maximum size.
+type AuditLog struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// auditLog is the audit log configured by flag, nil if disabled.
+var auditLog = sync.OnceValue(func() *AuditLog {
+	if *auditLogFile == "" {
+		return nil
+	}
+
+	return &AuditLog{path: *auditLogFile, maxSize: *auditLogMaxSize, maxFiles: *auditLogMaxFiles}
+})
+
+// AccessDenied records a denied access in the audit log and forwards it to the panel.
+func AccessDenied(event AccessDeniedEvent) {
+	event.Timestamp = uint64(time.Now().UnixMilli())
+
+	if audit := auditLog(); audit != nil {
+		if err := audit.Write(event); err != nil {
+			log.Println("audit log:", err)
+		}
+	}
+
+	websockets.SendTeamMessage(event.TeamID, websockets.MqttAccessDenied, event)
+}
+
+// Write appends the event to the log file, opening or rotating it first if needed.
+func (l *AuditLog) Write(event any) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil && l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if l.file == nil {
+		if err = l.open(); err != nil {
+			return err
+		}
+	}
+
+	written, err := l.file.Write(line)
+	l.size += int64(written)
+	return err
+}
+
+// Close closes the log file. A later Write opens it again.
+func (l *AuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the log file for appending.
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files by one (path.1 becomes path.2, ...), dropping the oldest, and moves the
+// current file to path.1.
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	if l.maxFiles < 1 {
+		return os.Remove(l.path)
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+
+	return os.Rename(l.path, l.path+".1")
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Rejection reasons the auth endpoint may send in its error body.
+const (
+	ReasonBadCredentials = "bad_credentials"
+	ReasonNotAuthorized  = "not_authorized"
+	ReasonBanned         = "banned"
+	ReasonServerBusy     = "server_busy"
+	ReasonQuotaExceeded  = "quota_exceeded"
+)
+
+// reasonCodes maps rejection reasons to the CONNACK reason code sent to the client.
+var reasonCodes = map[string]packets.Code{
+	ReasonBadCredentials: packets.ErrBadUsernameOrPassword,
+	ReasonNotAuthorized:  packets.ErrNotAuthorized,
+	ReasonBanned:         packets.ErrBanned,
+	ReasonServerBusy:     packets.ErrServerBusy,
+	ReasonQuotaExceeded:  packets.ErrQuotaExceeded,
+}
+
+// AuthError is a rejection returned by the auth endpoint with a non-2xx status.
+type AuthError struct {
+	Status  int    `json:"-"`       // HTTP status code of the response
+	Reason  string `json:"reason"`  // Machine readable rejection reason
+	Message string `json:"message"` // Human readable description
+}
+
+// Error describes the rejection.
+func (e *AuthError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("auth service rejected credentials with status %d: %s (%s)", e.Status, e.Message, e.Reason)
+	}
+
+	return fmt.Sprintf("auth service rejected credentials with status %d (%s)", e.Status, e.Reason)
+}
+
+// Code returns the CONNACK reason code for the rejection, derived from its reason or else its status.
+func (e *AuthError) Code() packets.Code {
+	if code, ok := reasonCodes[e.Reason]; ok {
+		return code
+	}
+
+	switch e.Status {
+	case http.StatusForbidden:
+		return packets.ErrNotAuthorized
+	case http.StatusTooManyRequests:
+		return packets.ErrServerBusy
+	default:
+		return packets.ErrBadUsernameOrPassword
+	}
+}
+
+// newAuthError reads the structured error body of a rejected request. Bodies that are not JSON are ignored.
+func newAuthError(response *http.Response) *AuthError {
+	authError := &AuthError{}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	_ = json.Unmarshal(body, authError)
+
+	authError.Status = response.StatusCode
+	return authError
+}
+
+// ReasonCode returns the CONNACK reason code a client should be rejected with after a failed authentication.
+func ReasonCode(err error) packets.Code {
+	var authError *AuthError
+	var code packets.Code
+
+	switch {
+	case errors.As(err, &authError):
+		return authError.Code()
+	case errors.As(err, &code):
+		return code
+	case errors.Is(err, ErrCircuitOpen), errors.As(err, new(*retryableError)):
+		return packets.ErrServerUnavailable
+	default:
+		return packets.ErrBadUsernameOrPassword
+	}
+}
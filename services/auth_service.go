@@ -1,19 +1,20 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"net/http"
+	"log"
 	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
 )
 
-// Define flags for remote path, token TTL, and ticker interval.
+// Define flags for token TTL and ticker interval.
 var (
-	remotePath     = flag.String("auth-url", "http://mqtt-panel.test/api/mqtt/auth", "URL of the remote authentication service")
 	tokenTTL       = flag.Duration("api-token-ttl", 24*time.Hour, "Time-to-live (TTL) in seconds for each authentication token")
+	expiryMode     = flag.String("auth-expiry-mode", "sliding", "Token expiry mode: sliding extends the TTL on every use, absolute never does")
 	tickerInterval = flag.Duration("auto-clean-interval", 168*time.Hour, "Interval for the auto-cleaner ticker")
 )
 
@@ -23,45 +24,137 @@ type AuthenticatedToken struct {
 	MqttClientID uint64 // MQTT Client ID associated with the token
 	ApiTokenID   uint64 // API Token ID associated with the token
 	TTL          uint64 // Time-to-Live (expiration) for the token, in UNIX timestamp format
+	LastUsed     uint64 // Last time the token authenticated or authorized its client, in UNIX timestamp format
+	ExpiresAt    uint64 // Absolute expiry the TTL never slides past, in UNIX timestamp format, 0 if none
+	Lifetime     uint64 // TTL in seconds granted by the backend, 0 to use the api-token-ttl flag
+
+	Permissions *TopicPermissions // Topic filters the token may publish and subscribe to, nil if none were sent
+	TeamQuotas  *TeamQuotas       // Quotas of the team sent by the backend, nil to use the configured ones
+
+	SecretSalt  []byte // Random salt of the secret hash
+	SecretHash  []byte // Salted SHA-256 hash of the secret that produced the token, empty for certificate logins
+	Certificate string // SHA-256 fingerprint of the client certificate that produced the token, empty for password logins
 }
 
 // AuthService manages active authenticated tokens and periodically cleans up expired ones.
+// It is safe for concurrent use by every client goroutine.
 type AuthService struct {
-	AuthenticatedList map[string]*AuthenticatedToken // Stores tokens by unique authentication key
+	AuthenticatedList *TokenStore       // Stores tokens by unique authentication key
+	Backend           Authenticator     // Validates credentials that are not cached
+	Persistence       *TokenPersistence // Persists the stored tokens across restarts, nil if disabled
+	ScramSource       ScramSource       // Provides SCRAM credential material, nil if SCRAM is disabled
+
+	inflight inflightGroup // Collapses concurrent backend calls for the same credentials
+	stale    staleClients  // Clients admitted with an expired token while the auth API was down
+	scram    scramCache    // SCRAM credential material by authentication key
+	acl      aclCache      // ACL decisions by authentication key
 }
 
 // AuthServiceInstance Global instance of AuthService.
 var AuthServiceInstance *AuthService
 
-// AuthServiceInit initializes the AuthService and starts the auto-cleaner.
-func AuthServiceInit() *AuthService {
+// AuthServiceInit initializes the AuthService with the backend selected by flag and starts the auto-cleaner.
+func AuthServiceInit() (*AuthService, error) {
+	if *expiryMode != "sliding" && *expiryMode != "absolute" {
+		return nil, fmt.Errorf("unknown auth expiry mode %q", *expiryMode)
+	}
+
+	if err := loadTeamQuotas(); err != nil {
+		return nil, err
+	}
+
+	if err := loadACLPolicy(); err != nil {
+		return nil, err
+	}
+
+	if err := validateCertificateAuth(); err != nil {
+		return nil, err
+	}
+
+	backend, err := NewAuthenticator(*authBackend)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new AuthService with an initialized token map.
 	AuthServiceInstance = &AuthService{
-		AuthenticatedList: make(map[string]*AuthenticatedToken),
+		AuthenticatedList: NewTokenStore(),
+		Backend:           backend,
 	}
 
-	// Start the automatic cleanup of expired tokens.
-	setupAutoCleaner(context.Background())
-	return AuthServiceInstance
+	if ScramEnabled() {
+		if AuthServiceInstance.ScramSource, err = NewScramSource(*scramSource); err != nil {
+			return nil, err
+		}
+	}
+
+	// Restore the tokens of the previous run, so restarts don't authenticate every client again.
+	if *cacheFile != "" {
+		if err = AuthServiceInstance.restore(*cacheFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start the automatic cleanup of expired tokens and the re-validation of stale ones.
+	AuthServiceInstance.setupAutoCleaner(context.Background())
+	AuthServiceInstance.setupRevalidation(context.Background())
+	return AuthServiceInstance, nil
+}
+
+// restore loads the persisted tokens that have not expired and writes every later change through to the file.
+func (s *AuthService) restore(path string) error {
+	persistence, err := OpenTokenPersistence(path)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := persistence.Load(s.AuthenticatedList, unixNow())
+	if err != nil {
+		_ = persistence.Close()
+		return fmt.Errorf("load %s: %w", path, err)
+	}
+
+	log.Println("token cache: restored", loaded, "tokens")
+	s.Persistence = persistence
+	s.AuthenticatedList.persistence = persistence
+	return nil
+}
+
+// Close closes the persistent token cache and the audit log, if any.
+func (s *AuthService) Close() error {
+	if audit := auditLog(); audit != nil {
+		_ = audit.Close()
+	}
+
+	if s.Persistence == nil {
+		return nil
+	}
+
+	return s.Persistence.Close()
 }
 
 // setupAutoCleaner starts a background goroutine that periodically deletes expired tokens.
-func setupAutoCleaner(ctx context.Context) {
+func (s *AuthService) setupAutoCleaner(ctx context.Context) {
+	// Set a ticker to trigger at the interval specified by the tickerInterval flag.
+	ticker := time.NewTicker(*tickerInterval)
+
 	go func() {
-		// Set a ticker to trigger at the interval specified by the tickerInterval flag.
-		ticker := time.NewTicker(*tickerInterval)
 		defer ticker.Stop() // Ensure the ticker is stopped when the function exits.
 
 		for {
 			select {
 			case <-ticker.C:
-				// On each tick, get the current time in UNIX format.
-				now := uint64(time.Now().Unix())
+				// On each tick, delete every token that has expired, keeping those still usable in grace mode.
+				s.AuthenticatedList.DeleteExpired(unixNow() - uint64(gracePeriod.Seconds()))
+				s.scram.deleteFunc(func(token *AuthenticatedToken) bool {
+					return token.Expired(unixNow())
+				})
+				s.acl.sweep(s.AuthenticatedList)
 
-				// Iterate over each token and delete if it has expired.
-				for key, token := range AuthServiceInstance.AuthenticatedList {
-					if token.TTL < now {
-						delete(AuthServiceInstance.AuthenticatedList, key)
+				// Compact the persisted tokens down to those still cached.
+				if persistence := s.Persistence; persistence != nil {
+					if err := persistence.Compact(s.AuthenticatedList); err != nil {
+						log.Println("token cache: compact:", err)
 					}
 				}
 			case <-ctx.Done():
@@ -72,89 +165,138 @@ func setupAutoCleaner(ctx context.Context) {
 	}()
 }
 
-// Authenticate verifies credentials, either by cache lookup or remote authentication.
-func (s *AuthService) Authenticate(clientId, username, password string) bool {
+// Authenticate verifies credentials, either by cache lookup or backend authentication. The returned error
+// explains a rejection and can be mapped to a CONNACK reason code with ReasonCode.
+func (s *AuthService) Authenticate(clientId, username, password string) error {
 	// Generate a unique key for this client using their credentials.
 	authKey := clientId + "::" + username
 
-	// Check if the token is already in the cache and hasn't expired.
-	if cache := s.AuthenticatedList[authKey]; cache != nil && cache.TTL > uint64(time.Now().Unix()) {
-		cache.TTL = newTTL()
-		return true // Token is valid in cache, return success and update.
+	// Check if the token is already in the cache, hasn't expired and was produced by the same password.
+	if cache := s.Lookup(clientId, username); cache != nil && cache.MatchesSecret(password) {
+		cache.refresh()
+		return nil // Token is valid in cache, return success and update.
 	}
 
-	// ACL authentications use only clientId + username. No cache = unauthenticated
-	if password == "" {
-		return false
+	// Perform backend authentication if token is not in cache or has expired.
+	credentials := Credentials{ClientID: clientId, Username: username, Password: password}
+	if err := s.authenticate(authKey, credentials); err != nil {
+		// While the auth API is down, clients with a recently expired token may be admitted in grace mode.
+		if errors.Is(err, ErrCircuitOpen) && s.admitStale(authKey, credentials) {
+			log.Println("auth grace: admitting stale client", authKey)
+			return nil
+		}
+
+		// Log and return the error if backend authentication fails.
+		log.Println("auth: authenticating:", err)
+		return err
 	}
 
-	// Perform remote authentication if token is not in cache or has expired.
-	authentication, err := handleRemoteAuthentication(clientId, username, password)
-	if err != nil {
-		// Log the error and return false if remote authentication fails.
-		fmt.Println("Error authenticating:", err)
-		return false
+	return nil
+}
+
+// Reauthenticate verifies credentials with the backend even if a token is cached. The cached token is kept while
+// the backend is unavailable, so connected clients stay authorized, and removed once the backend refuses them.
+func (s *AuthService) Reauthenticate(clientId, username, password string) error {
+	credentials := Credentials{ClientID: clientId, Username: username, Password: password}
+	err := s.authenticate(clientId+"::"+username, credentials)
+	if err == nil || ReasonCode(err) == packets.ErrServerUnavailable {
+		return err
 	}
 
-	// Cache the new authentication token for future requests.
-	s.AuthenticatedList[authKey] = authentication
-	return true
+	log.Println("auth: re-authenticating:", err)
+	s.Invalidate(clientId, username)
+	return err
 }
 
-// handleRemoteAuthentication makes a remote call to validate credentials and returns a token.
-func handleRemoteAuthentication(clientId, username, password string) (*AuthenticatedToken, error) {
-	// Send an HTTP POST request with the provided credentials.
-	response, err := sendRequest(clientId, username, password)
-	if err != nil {
-		return nil, err // Return an error if the request fails.
+// authenticate verifies credentials with the backend and caches the token they produce. Concurrent attempts with
+// the same credentials share a single backend call.
+func (s *AuthService) authenticate(authKey string, credentials Credentials) error {
+	// Empty secrets are never sent to the backend.
+	if credentials.Password == "" {
+		return ErrInvalidCredentials
 	}
 
-	//goland:noinspection GoUnhandledErrorResult
-	defer response.Body.Close() // Ensure the response body is closed to prevent memory leaks.
+	_, err := s.inflight.Do(authKey+"::"+string(hashSecret(nil, credentials.Password)), func() (*AuthenticatedToken, error) {
+		authentication, err := s.Backend.Authenticate(context.Background(), credentials)
+		if err != nil {
+			return nil, err
+		}
+
+		// Cache the new authentication token for future requests, bound to the password that produced it.
+		if err = authentication.bindSecret(credentials.Password); err != nil {
+			return nil, fmt.Errorf("hash secret: %w", err)
+		}
+
+		s.AuthenticatedList.Set(authKey, authentication)
+		return authentication, nil
+	})
+
+	return err
+}
+
+// Authorize checks whether a cached token allows the client to publish (write) or subscribe to the topic, and
+// returns the reason of a denial. Decisions are cached for as long as the client's token is unchanged.
+func (s *AuthService) Authorize(clientId, username, topic string, write bool) error {
+	// ACL checks use only clientId + username. No cache = unauthenticated
+	authKey := clientId + "::" + username
+	token := s.lookup(authKey)
+	if token == nil {
+		s.acl.delete(authKey)
+		return ErrNotAuthenticated
+	}
 
-	// Parse the response body.
-	var responseContent map[string]uint64
-	if err = json.NewDecoder(response.Body).Decode(&responseContent); err != nil {
-		return nil, err // Return an error if JSON decoding fails.
+	query := aclQuery{topic: topic, write: write}
+	if decision, ok := s.acl.get(authKey, token, query); ok {
+		return decision
 	}
 
-	// Create a new AuthenticatedToken using the data from the response.
-	return &AuthenticatedToken{
-		TeamID:       responseContent["team_id"],
-		MqttClientID: responseContent["mqtt_client_id"],
-		ApiTokenID:   responseContent["api_token_id"],
-		TTL:          newTTL(),
-	}, nil
+	decision := s.authorize(token, clientId, username, topic, write)
+	s.acl.put(authKey, token, query, decision)
+	return decision
 }
 
-// sendRequest sends a POST request with credentials to the authentication endpoint.
-func sendRequest(clientId, username, password string) (*http.Response, error) {
-	// Create the JSON payload for the request.
-	requestData, err := json.Marshal(map[string]string{
-		"client_id":  clientId,
-		"api_key":    username,
-		"api_secret": password,
-	})
-	if err != nil {
-		return nil, err // Return an error if JSON encoding fails.
+// authorize evaluates the access of the client with the token to the topic.
+func (s *AuthService) authorize(token *AuthenticatedToken, clientId, username, topic string, write bool) error {
+	// Subscriptions and deliveries are checked after the topic was mounted, publishes before.
+	if !write {
+		var inNamespace bool
+		if topic, inNamespace = token.UnmountTopic(topic); !inNamespace {
+			return ErrOutsideNamespace
+		}
 	}
 
-	// Initialize a new HTTP request with JSON headers.
-	request, err := http.NewRequest("POST", *remotePath, bytes.NewReader(requestData))
-	if err != nil {
-		return nil, err // Return an error if request creation fails.
+	return token.Authorizes(clientId, username, topic, write)
+}
+
+// Lookup returns the cached token of an authenticated client without refreshing it, or nil if there is none.
+func (s *AuthService) Lookup(clientId, username string) *AuthenticatedToken {
+	cache := s.AuthenticatedList.Get(clientId + "::" + username)
+	if cache == nil || cache.Expired(unixNow()) {
+		return nil
 	}
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/json")
 
-	// Set up an HTTP client with a timeout to prevent indefinite hangs.
-	client := &http.Client{Timeout: 10 * time.Second}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err // Return an error if the request execution fails.
+	return cache
+}
+
+// Invalidate removes the cached token of a client, so its next authentication reaches the backend.
+func (s *AuthService) Invalidate(clientId, username string) {
+	s.AuthenticatedList.Delete(clientId + "::" + username)
+}
+
+// Forget removes the cached ACL decisions of a client once it disconnected.
+func (s *AuthService) Forget(clientId, username string) {
+	s.acl.delete(clientId + "::" + username)
+}
+
+// lookup returns the cached token for the key if it hasn't expired, refreshing its TTL.
+func (s *AuthService) lookup(authKey string) *AuthenticatedToken {
+	cache := s.AuthenticatedList.Get(authKey)
+	if cache == nil || cache.Expired(unixNow()) {
+		return nil
 	}
 
-	return response, nil // Return the HTTP response for further processing.
+	cache.refresh()
+	return cache
 }
 
 // newTTL creates a new timestamp expiry
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePanel serves the panel's authentication endpoint, accepting the api_secret "secret" for any client.
+func fakePanel(t *testing.T, requests *atomic.Int64) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		var payload map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if payload["api_secret"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"invalid credentials"}`))
+			return
+		}
+
+		clientID, _ := strconv.Atoi(payload["client_id"][len("client-"):])
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"team_id":        clientID%5 + 1,
+			"mqtt_client_id": clientID,
+			"api_token_id":   clientID,
+			"topics":         map[string][]string{"publish": {"sensors/#"}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAuthServiceConcurrentAuthenticate(t *testing.T) {
+	var requests atomic.Int64
+	panel := fakePanel(t, &requests)
+
+	service := &AuthService{
+		AuthenticatedList: NewTokenStore(),
+		Backend:           NewPanelAuthenticator(panel.URL),
+	}
+
+	// Run the cleaner as fast as possible alongside the clients.
+	previousInterval := *tickerInterval
+	*tickerInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	service.setupAutoCleaner(ctx)
+	*tickerInterval = previousInterval
+	defer cancel()
+
+	const clients, attempts = 50, 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients*attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clientID := "client-" + strconv.Itoa(i%clients)
+
+			// The last attempt of every client uses a wrong secret and must be refused without affecting the others.
+			password := "secret"
+			if i/clients == attempts-1 {
+				password = "wrong"
+			}
+
+			err := service.Authenticate(clientID, "key", password)
+			if (err == nil) != (password == "secret") {
+				t.Errorf("Authenticate(%s, %s) = %v", clientID, password, err)
+				return
+			}
+
+			if err == nil {
+				if err = service.Authorize(clientID, "key", "sensors/temperature", true); err != nil {
+					t.Errorf("Authorize(%s) = %v, want allowed", clientID, err)
+				}
+				if err = service.Authorize(clientID, "key", "other/topic", true); err == nil {
+					t.Errorf("Authorize(%s) allowed a topic outside its permissions", clientID)
+				}
+			}
+
+			// Expired tokens of other clients are stored meanwhile for the cleaner to remove.
+			service.AuthenticatedList.Set("expired-"+strconv.Itoa(i)+"::key", &AuthenticatedToken{TTL: unixNow() - 1})
+		}(i)
+	}
+	wg.Wait()
+
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	for i := 0; i < clients; i++ {
+		if service.Lookup("client-"+strconv.Itoa(i), "key") == nil {
+			t.Errorf("client-%d has no cached token", i)
+		}
+	}
+
+	if got := requests.Load(); got >= clients*attempts {
+		t.Errorf("panel received %d requests for %d attempts, cached tokens were not used", got, clients*attempts)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for service.AuthenticatedList.Len() > clients {
+		if time.Now().After(deadline) {
+			t.Fatalf("cleaner left %d tokens, want %d", service.AuthenticatedList.Len(), clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
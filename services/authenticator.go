@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Define flags for the authentication backend selection.
+var (
+	authBackend = flag.String("auth-backend", "panel", "Authentication backend: panel, file, jwt or chain")
+	authChain   = flag.String("auth-chain", "file,panel", "Comma separated backends tried in order by the chain backend")
+)
+
+// ErrInvalidCredentials is returned by backends that reject the presented credentials.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Credentials holds the values a client presented when connecting.
+type Credentials struct {
+	ClientID string // MQTT client identifier
+	Username string // MQTT username, the API key
+	Password string // MQTT password, the API secret
+}
+
+// Authenticator validates credentials against a backend and returns the resulting token.
+type Authenticator interface {
+	Authenticate(ctx context.Context, credentials Credentials) (*AuthenticatedToken, error)
+}
+
+// ChainAuthenticator tries several backends in order and returns the first successful authentication.
+type ChainAuthenticator []Authenticator
+
+// Authenticate returns the token of the first backend accepting the credentials, or all backend errors.
+func (c ChainAuthenticator) Authenticate(ctx context.Context, credentials Credentials) (*AuthenticatedToken, error) {
+	var errs []error
+	for _, backend := range c {
+		token, err := backend.Authenticate(ctx, credentials)
+		if err == nil {
+			return token, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, ErrInvalidCredentials // An empty chain accepts nobody.
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// NewAuthenticator creates the backend with the given name, configured from flags.
+func NewAuthenticator(name string) (Authenticator, error) {
+	switch name {
+	case "panel":
+		return NewPanelAuthenticator(*remotePath), nil
+	case "file":
+		return NewFileAuthenticator(*credentialsFile)
+	case "jwt":
+		return NewJWTAuthenticator(*jwksFile, *jwtAudience, *jwtIssuer)
+	case "chain":
+		var chain ChainAuthenticator
+		for _, member := range strings.Split(*authChain, ",") {
+			member = strings.TrimSpace(member)
+			if member == "chain" {
+				return nil, errors.New("chain backend cannot contain itself")
+			}
+
+			backend, err := NewAuthenticator(member)
+			if err != nil {
+				return nil, err
+			}
+
+			chain = append(chain, backend)
+		}
+
+		return chain, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication backend %q", name)
+	}
+}
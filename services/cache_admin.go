@@ -0,0 +1,77 @@
+package services
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// CacheEntry describes a cached token for the admin API, without its secret hash.
+type CacheEntry struct {
+	ClientID     string `json:"client_id"`
+	Username     string `json:"username"`
+	TeamID       uint64 `json:"team_id"`
+	MqttClientID uint64 `json:"mqtt_client_id"`
+	ApiTokenID   uint64 `json:"api_token_id"`
+	ExpiresAt    uint64 `json:"expires_at"`          // Current TTL, in UNIX timestamp format
+	AbsoluteExp  uint64 `json:"absolute_expires_at"` // Expiry the TTL never slides past, 0 if none
+	LastUsed     uint64 `json:"last_used"`           // Last authentication or authorization, in UNIX timestamp format
+	Expired      bool   `json:"expired"`             // Expired but kept until the next cleanup, e.g. for grace mode
+}
+
+// CacheFilter selects cache entries. Empty fields match every entry.
+type CacheFilter struct {
+	TeamID   uint64
+	ClientID string
+	Username string
+}
+
+// CacheEntries lists the cached tokens selected by the filter.
+func (s *AuthService) CacheEntries(filter CacheFilter) []CacheEntry {
+	now := unixNow()
+	entries := make([]CacheEntry, 0)
+
+	s.AuthenticatedList.Range(func(key string, token *AuthenticatedToken) bool {
+		clientId, username, _ := strings.Cut(key, "::")
+		if (filter.TeamID != 0 && token.TeamID != filter.TeamID) ||
+			(filter.ClientID != "" && clientId != filter.ClientID) ||
+			(filter.Username != "" && username != filter.Username) {
+			return true
+		}
+
+		entries = append(entries, CacheEntry{
+			ClientID:     clientId,
+			Username:     username,
+			TeamID:       token.TeamID,
+			MqttClientID: token.MqttClientID,
+			ApiTokenID:   token.ApiTokenID,
+			ExpiresAt:    atomic.LoadUint64(&token.TTL),
+			AbsoluteExp:  token.ExpiresAt,
+			LastUsed:     atomic.LoadUint64(&token.LastUsed),
+			Expired:      token.Expired(now),
+		})
+		return true
+	})
+
+	return entries
+}
+
+// Evict removes the cached token of a client and reports whether there was one. The client stays connected
+// and is re-authenticated by the session supervisor.
+func (s *AuthService) Evict(clientId, username string) bool {
+	authKey := clientId + "::" + username
+	if s.AuthenticatedList.Get(authKey) == nil {
+		return false
+	}
+
+	s.AuthenticatedList.Delete(authKey)
+	return true
+}
+
+// Flush removes every cached token and SCRAM credential and returns the number of removed tokens.
+func (s *AuthService) Flush() int {
+	s.scram.deleteFunc(func(*AuthenticatedToken) bool { return true })
+
+	return len(s.AuthenticatedList.DeleteFunc(func(string, *AuthenticatedToken) bool {
+		return true
+	}))
+}
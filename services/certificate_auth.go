@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Define flags for client certificate (mTLS) authentication.
+var (
+	certificateAuth     = flag.Bool("mtls-auth", false, "Authenticate clients presenting a verified TLS client certificate by their certificate")
+	certificateIdentity = flag.String("mtls-identity", "{cn}", "Template mapping a client certificate to its identity: {cn}, {o}, {ou}, {serial}, {dns}, {email}, {uri}, {fingerprint}")
+	certificateResolve  = flag.String("mtls-resolve-url", "", "Panel URL resolving certificate identities to team and client IDs, empty to trust the certificate alone")
+)
+
+// CertificateIdentity describes the verified client certificate a client connected with.
+type CertificateIdentity struct {
+	Identity    string `json:"identity"`    // Identity derived from the certificate by the configured template
+	Subject     string `json:"subject"`     // Distinguished name of the certificate subject
+	Fingerprint string `json:"fingerprint"` // Hex encoded SHA-256 fingerprint of the certificate
+}
+
+// CertificateAuthEnabled reports whether clients with a verified certificate are authenticated by it.
+func CertificateAuthEnabled() bool {
+	return *certificateAuth
+}
+
+// ClientCertificate returns the verified client certificate of a connection, or nil if there is none.
+func ClientCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn := unwrapTLSConn(conn)
+	if tlsConn == nil {
+		return nil
+	}
+
+	// Only certificates verified against the configured CA bundle are trusted.
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
+
+// unwrapTLSConn finds the *tls.Conn behind a connection. Websocket listeners wrap it in a struct
+// embedding the underlying net.Conn, which is followed until a TLS connection is found.
+func unwrapTLSConn(conn net.Conn) *tls.Conn {
+	for conn != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			return tlsConn
+		}
+
+		value := reflect.ValueOf(conn)
+		if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+			return nil
+		}
+
+		embedded := value.Elem().FieldByName("Conn")
+		if !embedded.IsValid() || !embedded.CanInterface() {
+			return nil
+		}
+
+		conn, _ = embedded.Interface().(net.Conn)
+	}
+
+	return nil
+}
+
+// NewCertificateIdentity describes a certificate, deriving its identity from the configured template.
+func NewCertificateIdentity(certificate *x509.Certificate) CertificateIdentity {
+	fingerprint := sha256.Sum256(certificate.Raw)
+	identity := CertificateIdentity{
+		Subject:     certificate.Subject.String(),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+
+	identity.Identity = strings.NewReplacer(
+		"{cn}", certificate.Subject.CommonName,
+		"{o}", first(certificate.Subject.Organization),
+		"{ou}", first(certificate.Subject.OrganizationalUnit),
+		"{serial}", certificate.SerialNumber.String(),
+		"{dns}", first(certificate.DNSNames),
+		"{email}", first(certificate.EmailAddresses),
+		"{uri}", firstURI(certificate),
+		"{fingerprint}", identity.Fingerprint,
+	).Replace(*certificateIdentity)
+
+	return identity
+}
+
+// AuthenticateCertificate verifies a client by its certificate, either by cache lookup or by resolving
+// its identity with the panel. The cached token records the certificate fingerprint and holds no secret,
+// so password logins can never match it.
+func (s *AuthService) AuthenticateCertificate(clientId, username string, certificate *x509.Certificate) error {
+	identity := NewCertificateIdentity(certificate)
+
+	// Check if the token is already in the cache, hasn't expired and was produced by the same certificate.
+	if cache := s.Lookup(clientId, username); cache != nil && cache.Certificate == identity.Fingerprint {
+		cache.refresh()
+		return nil
+	}
+
+	if err := s.authenticateCertificate(clientId, username, identity); err != nil {
+		log.Println("mtls: authenticating:", err)
+		return err
+	}
+
+	return nil
+}
+
+// ReauthenticateCertificate verifies a client by its certificate even if a token is cached. The cached token is
+// kept while the panel is unavailable, and removed once the certificate is refused.
+func (s *AuthService) ReauthenticateCertificate(clientId, username string, certificate *x509.Certificate) error {
+	err := s.authenticateCertificate(clientId, username, NewCertificateIdentity(certificate))
+	if err == nil || ReasonCode(err) == packets.ErrServerUnavailable {
+		return err
+	}
+
+	log.Println("mtls: re-authenticating:", err)
+	s.Invalidate(clientId, username)
+	return err
+}
+
+// authenticateCertificate resolves the certificate identity and caches the token it produces. Concurrent
+// attempts with the same certificate share a single call.
+func (s *AuthService) authenticateCertificate(clientId, username string, identity CertificateIdentity) error {
+	if identity.Identity == "" {
+		return fmt.Errorf("%w: certificate identity is empty", ErrInvalidCredentials)
+	}
+
+	authKey := clientId + "::" + username
+	_, err := s.inflight.Do(authKey+"::"+identity.Fingerprint, func() (*AuthenticatedToken, error) {
+		authentication, err := resolveCertificate(context.Background(), clientId, identity)
+		if err != nil {
+			return nil, err
+		}
+
+		// The fingerprint is public, it only tells which certificate the token belongs to.
+		authentication.Certificate = identity.Fingerprint
+		authentication.SecretSalt, authentication.SecretHash = nil, nil
+
+		s.AuthenticatedList.Set(authKey, authentication)
+		return authentication, nil
+	})
+
+	return err
+}
+
+// validateCertificateAuth refuses to trust certificates alone when their tokens would be denied every topic.
+// Without a resolve URL they carry no team and no permissions, so the ACL must grant them access.
+func validateCertificateAuth() error {
+	if !*certificateAuth || *certificateResolve != "" {
+		return nil
+	}
+
+	if NamespaceEnabled() {
+		return errors.New("mtls-auth without mtls-resolve-url cannot be used with team-namespace, certificate tokens have no team")
+	}
+
+	if !*aclDefaultAllow && len(configuredPolicy.Read.Allow) == 0 && len(configuredPolicy.Write.Allow) == 0 {
+		return errors.New("mtls-auth without mtls-resolve-url requires acl-default-allow or allow rules in acl-policy-file, certificate tokens have no permissions")
+	}
+
+	return nil
+}
+
+// resolveCertificate asks the panel to resolve a certificate identity to team and client IDs if configured,
+// otherwise the verified certificate is trusted for the client ID equal to its identity.
+func resolveCertificate(ctx context.Context, clientId string, identity CertificateIdentity) (*AuthenticatedToken, error) {
+	if *certificateResolve == "" {
+		if identity.Identity != clientId {
+			return nil, fmt.Errorf("%w: certificate identity %q does not match client ID %q",
+				ErrInvalidCredentials, identity.Identity, clientId)
+		}
+
+		return &AuthenticatedToken{TTL: newTTL()}, nil
+	}
+
+	return NewPanelAuthenticator(*certificateResolve).requestToken(ctx, *certificateResolve, map[string]string{
+		"client_id":   clientId,
+		"identity":    identity.Identity,
+		"subject":     identity.Subject,
+		"fingerprint": identity.Fingerprint,
+	})
+}
+
+// first returns the first value of a list, or an empty string.
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// firstURI returns the first URI subject alternative name of a certificate, or an empty string.
+func firstURI(certificate *x509.Certificate) string {
+	if len(certificate.URIs) == 0 {
+		return ""
+	}
+
+	return certificate.URIs[0].String()
+}
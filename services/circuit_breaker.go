@@ -0,0 +1,171 @@
+package services
+
+import (
+	"broker-manager/websockets"
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+// Define flags for the circuit breaker around panel requests.
+var (
+	breakerThreshold = flag.Int("auth-breaker-threshold", 5, "Consecutive failed panel requests that open the circuit breaker")
+	breakerCooldown  = flag.Duration("auth-breaker-cooldown", 30*time.Second, "Time the circuit breaker stays open before probing the panel again")
+)
+
+// ErrCircuitOpen is returned without contacting the panel while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("auth service circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // Requests flow normally
+	BreakerOpen     BreakerState = "open"      // Requests fail fast until the cooldown elapses
+	BreakerHalfOpen BreakerState = "half-open" // A single probe request decides whether to close or reopen
+)
+
+// AuthBreakerChangedEvent reports a state transition of the circuit breaker around the auth API.
+type AuthBreakerChangedEvent struct {
+	State         BreakerState `json:"state"`
+	PreviousState BreakerState `json:"previous_state"`
+	Error         string       `json:"error,omitempty"`
+	Timestamp     uint64       `json:"timestamp"`
+}
+
+// CircuitBreaker stops requests to a failing service after consecutive failures and probes it again after
+// a cooldown.
+type CircuitBreaker struct {
+	Threshold int                                    // Consecutive failures that open the breaker
+	Cooldown  time.Duration                          // Time the breaker stays open before a probe is allowed
+	OnChange  func(from, to BreakerState, err error) // Called on every state transition
+
+	mutex    sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// panelBreaker guards every request to the panel, created once flags are parsed.
+var panelBreaker = sync.OnceValue(func() *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: max(*breakerThreshold, 1),
+		Cooldown:  *breakerCooldown,
+		OnChange:  breakerChanged,
+	}
+})
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.current()
+}
+
+// current returns the state, treating the zero value as closed. The caller must hold the lock.
+func (b *CircuitBreaker) current() BreakerState {
+	if b.state == "" {
+		return BreakerClosed
+	}
+
+	return b.state
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent. Once the cooldown elapsed, a single probe
+// request is allowed through while the breaker is half-open. Every allowed request must be followed by
+// a call to Success or Failure.
+func (b *CircuitBreaker) Allow() error {
+	b.mutex.Lock()
+
+	switch b.current() {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			b.mutex.Unlock()
+			return ErrCircuitOpen
+		}
+
+		b.state = BreakerHalfOpen
+		b.probing = true
+		b.mutex.Unlock()
+
+		b.notify(BreakerOpen, BreakerHalfOpen, nil)
+		return nil
+	case BreakerHalfOpen:
+		defer b.mutex.Unlock()
+		if b.probing {
+			return ErrCircuitOpen
+		}
+
+		b.probing = true
+		return nil
+	default:
+		b.mutex.Unlock()
+		return nil
+	}
+}
+
+// Success records a request that reached the service and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	previous := b.current()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+	b.mutex.Unlock()
+
+	if previous != BreakerClosed {
+		b.notify(previous, BreakerClosed, nil)
+	}
+}
+
+// Failure records a failed request, opening the breaker after too many consecutive failures or a failed probe.
+func (b *CircuitBreaker) Failure(err error) {
+	b.mutex.Lock()
+	previous := b.current()
+	b.failures++
+	b.probing = false
+	if previous == BreakerClosed && b.failures < b.Threshold {
+		b.mutex.Unlock()
+		return
+	}
+
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.mutex.Unlock()
+
+	if previous != BreakerOpen {
+		b.notify(previous, BreakerOpen, err)
+	}
+}
+
+// notify reports a state transition to the OnChange callback.
+func (b *CircuitBreaker) notify(from, to BreakerState, err error) {
+	if b.OnChange != nil {
+		b.OnChange(from, to, err)
+	}
+}
+
+// breakerChanged logs transitions of the panel breaker and reports them to the panel.
+func breakerChanged(from, to BreakerState, err error) {
+	log.Println("auth breaker:", from, "->", to, err)
+
+	event := AuthBreakerChangedEvent{
+		State:         to,
+		PreviousState: from,
+		Timestamp:     uint64(time.Now().UnixMilli()),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	websockets.SendMessage(websockets.MqttAuthBreakerChanged, event)
+
+	// Clients admitted during the outage are re-validated as soon as the panel is reachable again.
+	if to == BreakerClosed && AuthServiceInstance != nil {
+		go AuthServiceInstance.revalidateStale()
+	}
+}
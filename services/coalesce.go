@@ -0,0 +1,46 @@
+package services
+
+import "sync"
+
+// inflightGroup collapses concurrent authentications with the same key into a single backend call,
+// so a reconnecting fleet doesn't send the panel one request per duplicate connection.
+type inflightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*inflightCall
+}
+
+// inflightCall is a backend call whose result is shared by every caller waiting on it.
+type inflightCall struct {
+	done  chan struct{}
+	token *AuthenticatedToken
+	err   error
+}
+
+// Do runs fn once per key at a time; callers arriving while it runs wait for and share its result.
+func (g *inflightGroup) Do(key string, fn func() (*AuthenticatedToken, error)) (*AuthenticatedToken, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*inflightCall)
+	}
+
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+
+	call := &inflightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	// Release waiters and forget the call once it is done, so later attempts hit the cache or retry.
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.token, call.err = fn()
+	return call.token, call.err
+}
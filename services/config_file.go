@@ -0,0 +1,23 @@
+package services
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile decodes a YAML or JSON configuration file into out. YAML is a superset of JSON, so both formats
+// are decoded the same way.
+func loadConfigFile(path string, out any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err = yaml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return nil
+}
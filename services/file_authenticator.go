@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Define flags for the static credentials file backend.
+var (
+	credentialsFile = flag.String("auth-credentials-file", "credentials.yaml", "YAML or JSON file with bcrypt hashed credentials for the file backend")
+)
+
+// FileCredential is a single client entry of a static credentials file.
+type FileCredential struct {
+	ClientID     string            `yaml:"client_id"`      // Client ID the entry is restricted to, empty for any
+	Username     string            `yaml:"username"`       // API key presented as the MQTT username
+	PasswordHash string            `yaml:"password_hash"`  // bcrypt hash of the API secret
+	TeamID       uint64            `yaml:"team_id"`        // Team ID stored on the token
+	MqttClientID uint64            `yaml:"mqtt_client_id"` // MQTT Client ID stored on the token
+	ApiTokenID   uint64            `yaml:"api_token_id"`   // API Token ID stored on the token
+	Topics       *TopicPermissions `yaml:"topics"`         // Topic filters stored on the token
+	Quotas       *TeamQuotas       `yaml:"quotas"`         // Quotas of the team stored on the token
+	Scram        *ScramSecret      `yaml:"scram"`          // SCRAM-SHA-256 credential material, nil if the entry has none
+}
+
+// FileAuthenticator validates credentials against a static list loaded from a file, for local development and tests.
+type FileAuthenticator struct {
+	Credentials []FileCredential
+}
+
+// NewFileAuthenticator loads a file backend from a YAML or JSON credentials file.
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	var file struct {
+		Credentials []FileCredential `yaml:"credentials"`
+	}
+	if err := loadConfigFile(path, &file); err != nil {
+		return nil, err
+	}
+
+	for _, credential := range file.Credentials {
+		if credential.Username == "" || (credential.PasswordHash == "" && credential.Scram == nil) {
+			return nil, errors.New("credentials file entries require a username and a password_hash or scram material")
+		}
+	}
+
+	return &FileAuthenticator{Credentials: file.Credentials}, nil
+}
+
+// Authenticate returns a token for the first entry matching the client ID, username and password.
+func (a *FileAuthenticator) Authenticate(_ context.Context, credentials Credentials) (*AuthenticatedToken, error) {
+	for _, entry := range a.Credentials {
+		if entry.Username != credentials.Username || entry.PasswordHash == "" {
+			continue
+		}
+
+		if entry.ClientID != "" && entry.ClientID != credentials.ClientID {
+			continue
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(entry.PasswordHash), []byte(credentials.Password)) != nil {
+			continue
+		}
+
+		return entry.token(), nil
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// token creates the token granted by the entry.
+func (c FileCredential) token() *AuthenticatedToken {
+	return &AuthenticatedToken{
+		TeamID:       c.TeamID,
+		MqttClientID: c.MqttClientID,
+		ApiTokenID:   c.ApiTokenID,
+		TTL:          newTTL(),
+		Permissions:  c.Topics,
+		TeamQuotas:   c.Quotas,
+	}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Define flags for the stale-while-revalidate (grace) mode.
+var (
+	gracePeriod = flag.Duration("auth-grace-period", 0, "Admit clients whose token expired less than this long ago while the auth API is down, 0 disables")
+)
+
+// staleClients tracks clients admitted with an expired token while the auth API was down, together with the
+// credentials needed to re-validate them. Credentials are only kept in memory until re-validation.
+type staleClients struct {
+	mutex        sync.Mutex
+	credentials  map[string]Credentials
+	revalidating atomic.Bool
+}
+
+// GraceEnabled reports whether clients with recently expired tokens are admitted while the auth API is down.
+func GraceEnabled() bool {
+	return *gracePeriod > 0
+}
+
+// admitStale admits a client with a recently expired token whose secret matches, extending the token for the
+// grace period and queueing it for re-validation.
+func (s *AuthService) admitStale(authKey string, credentials Credentials) bool {
+	if !GraceEnabled() {
+		return false
+	}
+
+	token := s.AuthenticatedList.Get(authKey)
+	if token == nil || !token.MatchesSecret(credentials.Password) {
+		return false
+	}
+
+	now := unixNow()
+	grace := uint64(gracePeriod.Seconds())
+	if atomic.LoadUint64(&token.TTL)+grace <= now {
+		return false // Expired too long ago to be trusted.
+	}
+
+	atomic.StoreUint64(&token.TTL, now+grace)
+
+	s.stale.mutex.Lock()
+	defer s.stale.mutex.Unlock()
+
+	if s.stale.credentials == nil {
+		s.stale.credentials = make(map[string]Credentials)
+	}
+	s.stale.credentials[authKey] = credentials
+	return true
+}
+
+// revalidateStale re-authenticates clients admitted during an outage. Rejected clients lose their cached token,
+// while clients that cannot be checked yet stay queued.
+func (s *AuthService) revalidateStale() {
+	if !s.stale.revalidating.CompareAndSwap(false, true) {
+		return // Already running.
+	}
+	defer s.stale.revalidating.Store(false)
+
+	s.stale.mutex.Lock()
+	pending := make(map[string]Credentials, len(s.stale.credentials))
+	for key, credentials := range s.stale.credentials {
+		pending[key] = credentials
+	}
+	s.stale.mutex.Unlock()
+
+	for authKey, credentials := range pending {
+		token, err := s.Backend.Authenticate(context.Background(), credentials)
+		if err != nil && (errors.Is(err, ErrCircuitOpen) || errors.As(err, new(*retryableError))) {
+			return // The auth API is still unavailable, try again later.
+		}
+
+		if err == nil {
+			err = token.bindSecret(credentials.Password)
+		}
+
+		if err == nil {
+			s.AuthenticatedList.Set(authKey, token)
+		} else {
+			log.Println("auth grace: re-validating", authKey+":", err)
+			s.AuthenticatedList.Delete(authKey)
+		}
+
+		s.stale.mutex.Lock()
+		delete(s.stale.credentials, authKey)
+		s.stale.mutex.Unlock()
+	}
+}
+
+// setupRevalidation periodically retries re-validating stale clients, probing the auth API once the breaker
+// cooldown elapsed.
+func (s *AuthService) setupRevalidation(ctx context.Context) {
+	if !GraceEnabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(max(*breakerCooldown, time.Second))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.stale.mutex.Lock()
+				pending := len(s.stale.credentials)
+				s.stale.mutex.Unlock()
+
+				if pending > 0 {
+					s.revalidateStale()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
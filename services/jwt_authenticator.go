@@ -0,0 +1,386 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define flags for the local JWT authentication backend.
+var (
+	jwksFile           = flag.String("jwt-jwks-file", "jwks.json", "JWKS file with the public keys used to verify JWT passwords")
+	jwtAudience        = flag.String("jwt-audience", "", "Required aud claim of JWT passwords, empty to skip the check")
+	jwtIssuer          = flag.String("jwt-issuer", "", "Required iss claim of JWT passwords, empty to skip the check")
+	jwtLeeway          = flag.Duration("jwt-leeway", 30*time.Second, "Clock skew tolerated when checking exp and nbf claims")
+	jwksReloadInterval = flag.Duration("jwt-jwks-reload-interval", 30*time.Second, "Interval for checking the JWKS file for changes")
+)
+
+// Errors returned when a JWT password is rejected.
+var (
+	ErrMalformedJWT    = errors.New("malformed jwt")
+	ErrUnsupportedAlg  = errors.New("unsupported jwt algorithm")
+	ErrUnknownJWTKey   = errors.New("no jwks key matches the jwt")
+	ErrInvalidJWTSig   = errors.New("invalid jwt signature")
+	ErrInvalidJWTClaim = errors.New("invalid jwt claim")
+)
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the JWT claims used to build an AuthenticatedToken.
+type jwtClaims struct {
+	Issuer       string            `json:"iss"`
+	Audience     jwtAudienceClaim  `json:"aud"`
+	ExpiresAt    int64             `json:"exp"`
+	NotBefore    int64             `json:"nbf"`
+	ClientID     string            `json:"client_id"` // MQTT client identifier the token is restricted to, if any
+	TeamID       uint64            `json:"team_id"`
+	MqttClientID uint64            `json:"mqtt_client_id"`
+	ApiTokenID   uint64            `json:"api_token_id"`
+	Topics       *TopicPermissions `json:"topics"`
+	Quotas       *TeamQuotas       `json:"quotas"`
+}
+
+// jwtAudienceClaim holds the aud claim, which may be a single string or an array of strings.
+type jwtAudienceClaim []string
+
+// UnmarshalJSON accepts both forms of the aud claim.
+func (a *jwtAudienceClaim) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudienceClaim{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+
+	*a = multiple
+	return nil
+}
+
+// jwk is a single JSON Web Key of a JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a parsed public key together with the algorithm it verifies.
+type verificationKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// JWTAuthenticator verifies JWTs presented as MQTT passwords locally against a JWKS file,
+// without a round trip to the panel.
+type JWTAuthenticator struct {
+	Path     string // Path of the JWKS file
+	Audience string // Required audience, empty to skip the check
+	Issuer   string // Required issuer, empty to skip the check
+
+	mutex    sync.RWMutex
+	keys     []verificationKey
+	modified time.Time
+}
+
+// NewJWTAuthenticator loads the JWKS file and starts watching it for changes.
+func NewJWTAuthenticator(path, audience, issuer string) (*JWTAuthenticator, error) {
+	authenticator := &JWTAuthenticator{Path: path, Audience: audience, Issuer: issuer}
+	if err := authenticator.reload(); err != nil {
+		return nil, err
+	}
+
+	go authenticator.watch(context.Background(), *jwksReloadInterval)
+	return authenticator, nil
+}
+
+// watch reloads the JWKS file whenever its modification time changes.
+func (a *JWTAuthenticator) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(a.Path)
+			if err != nil {
+				log.Println("jwks:", err)
+				continue
+			}
+
+			a.mutex.RLock()
+			changed := !info.ModTime().Equal(a.modified)
+			a.mutex.RUnlock()
+
+			// Keep the previous keys if the new file cannot be used.
+			if changed {
+				if err = a.reload(); err != nil {
+					log.Println("jwks:", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload reads and parses the JWKS file, replacing the current keys.
+func (a *JWTAuthenticator) reload() error {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(a.Path)
+	if err != nil {
+		return err
+	}
+
+	var document struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("parse %s: %w", a.Path, err)
+	}
+
+	keys := make([]verificationKey, 0, len(document.Keys))
+	for _, key := range document.Keys {
+		parsed, err := parseJWK(key)
+		if err != nil {
+			return fmt.Errorf("parse key %q: %w", key.Kid, err)
+		}
+
+		keys = append(keys, parsed)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.keys = keys
+	a.modified = info.ModTime()
+	return nil
+}
+
+// Authenticate verifies the JWT in the password and builds a token from its claims.
+func (a *JWTAuthenticator) Authenticate(_ context.Context, credentials Credentials) (*AuthenticatedToken, error) {
+	parts := strings.Split(credentials.Password, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedJWT
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedJWT
+	}
+
+	if err = a.verify(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err = decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err = a.validateClaims(claims, credentials); err != nil {
+		return nil, err
+	}
+
+	token := &AuthenticatedToken{
+		TeamID:       claims.TeamID,
+		MqttClientID: claims.MqttClientID,
+		ApiTokenID:   claims.ApiTokenID,
+		ExpiresAt:    uint64(claims.ExpiresAt),
+		Permissions:  claims.Topics,
+		TeamQuotas:   claims.Quotas,
+	}
+	token.TTL = token.nextTTL()
+
+	return token, nil
+}
+
+// verify checks the signature against every key matching the header's kid and algorithm.
+func (a *JWTAuthenticator) verify(header jwtHeader, signed, signature []byte) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	matched := false
+	for _, key := range a.keys {
+		if (header.Kid != "" && key.kid != header.Kid) || (key.alg != "" && key.alg != header.Alg) {
+			continue
+		}
+
+		matched = true
+		if verifyJWTSignature(header.Alg, key.key, signed, signature) == nil {
+			return nil
+		}
+	}
+
+	if !matched {
+		return ErrUnknownJWTKey
+	}
+
+	return ErrInvalidJWTSig
+}
+
+// validateClaims checks the registered claims and the client binding of the JWT.
+func (a *JWTAuthenticator) validateClaims(claims jwtClaims, credentials Credentials) error {
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.Add(-*jwtLeeway).Unix() >= claims.ExpiresAt {
+		return fmt.Errorf("%w: token expired", ErrInvalidJWTClaim)
+	}
+
+	if claims.NotBefore != 0 && now.Add(*jwtLeeway).Unix() < claims.NotBefore {
+		return fmt.Errorf("%w: token not yet valid", ErrInvalidJWTClaim)
+	}
+
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", ErrInvalidJWTClaim)
+	}
+
+	if a.Audience != "" && !slices.Contains(claims.Audience, a.Audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidJWTClaim)
+	}
+
+	if claims.ClientID != "" && claims.ClientID != credentials.ClientID {
+		return fmt.Errorf("%w: token issued for another client", ErrInvalidJWTClaim)
+	}
+
+	return nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeJWTSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedJWT
+	}
+
+	if err = json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedJWT, err)
+	}
+
+	return nil
+}
+
+// verifyJWTSignature verifies a signature of the given algorithm with the public key.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+		}
+	case "ES256":
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(ecKey, digest[:], r, s) {
+				return nil
+			}
+			return ErrInvalidJWTSig
+		}
+	case "EdDSA":
+		if edKey, ok := key.(ed25519.PublicKey); ok {
+			if ed25519.Verify(edKey, signed, signature) {
+				return nil
+			}
+			return ErrInvalidJWTSig
+		}
+	default:
+		return ErrUnsupportedAlg
+	}
+
+	return ErrInvalidJWTSig // The key type does not match the algorithm.
+}
+
+// parseJWK converts a JSON Web Key into a public key.
+func parseJWK(key jwk) (verificationKey, error) {
+	parsed := verificationKey{kid: key.Kid, alg: key.Alg}
+
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return parsed, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return parsed, err
+		}
+
+		parsed.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		if key.Crv != "P-256" {
+			return parsed, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return parsed, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return parsed, err
+		}
+
+		ecKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !ecKey.Curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return parsed, errors.New("point is not on curve")
+		}
+
+		parsed.key = ecKey
+	case "OKP":
+		if key.Crv != "Ed25519" {
+			return parsed, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return parsed, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return parsed, errors.New("invalid ed25519 key size")
+		}
+
+		parsed.key = ed25519.PublicKey(x)
+	default:
+		return parsed, fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+
+	return parsed, nil
+}
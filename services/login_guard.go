@@ -0,0 +1,235 @@
+package services
+
+import (
+	"broker-manager/websockets"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Define flags for brute-force protection of authentications.
+var (
+	lockoutThreshold = flag.Int("auth-lockout-threshold", 5, "Consecutive failed authentications of a client ID, username and IP before it is locked out, 0 disables lockouts")
+	lockoutBase      = flag.Duration("auth-lockout-base", 30*time.Second, "First lockout duration, doubled by every further failure")
+	lockoutMax       = flag.Duration("auth-lockout-max", time.Hour, "Maximum lockout duration")
+	failureWindow    = flag.Duration("auth-failure-window", 15*time.Minute, "Time without failures after which failed authentications are forgotten")
+	negativeTTL      = flag.Duration("auth-negative-ttl", time.Minute, "Time a rejected secret is rejected again without asking the backend, 0 disables")
+	rateLimit        = flag.Float64("auth-rate-limit", 0, "Connection attempts per second allowed per IP, 0 disables the limit")
+	rateBurst        = flag.Int("auth-rate-burst", 20, "Connection attempts an IP may make at once before the rate limit applies")
+	banThreshold     = flag.Int("auth-ban-threshold", 0, "Lockouts of an IP within the ban duration after which the IP is banned, 0 disables bans")
+	banDuration      = flag.Duration("auth-ban-duration", time.Hour, "Time an IP stays banned")
+)
+
+// AuthLockoutEvent reports a client locked out, or an IP banned, after repeated failed authentications.
+type AuthLockoutEvent struct {
+	ClientID    string `json:"client_id"`
+	Username    string `json:"username"`
+	RemoteIP    string `json:"remote_ip"`
+	Failures    int    `json:"failures"`
+	Banned      bool   `json:"banned"`       // The whole IP was banned, not only the client ID and username
+	LockedUntil uint64 `json:"locked_until"` // End of the lockout or ban, in UNIX milliseconds
+	Timestamp   uint64 `json:"timestamp"`
+}
+
+// failedLogin remembers the failed authentications of a client ID, username and IP.
+type failedLogin struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	secretHash  string       // Hash of the last rejected secret
+	code        packets.Code // Reason code the last rejected secret was refused with
+}
+
+// remoteHost tracks the connection attempts and lockouts of an IP.
+type remoteHost struct {
+	tokens      float64 // Remaining connection attempts of the rate limiter bucket
+	refilled    time.Time
+	lockouts    int
+	lastLockout time.Time
+	bannedUntil time.Time
+}
+
+// LoginGuard protects the backend from brute-force attempts. It rejects secrets that were just refused
+// without asking the backend again, locks out client ID, username and IP combinations with an exponentially
+// growing duration after repeated failures, rate limits connection attempts per IP and bans IPs that keep
+// getting locked out.
+type LoginGuard struct {
+	mutex  sync.Mutex
+	logins map[string]*failedLogin // Failed authentications by client ID, username and IP
+	hosts  map[string]*remoteHost  // Connection attempts and bans by IP
+}
+
+// NewLoginGuard creates a LoginGuard configured by flags and starts forgetting stale entries.
+func NewLoginGuard() *LoginGuard {
+	guard := &LoginGuard{
+		logins: make(map[string]*failedLogin),
+		hosts:  make(map[string]*remoteHost),
+	}
+
+	go guard.cleanup(context.Background(), time.Minute)
+	return guard
+}
+
+// Check returns an error if an authentication attempt must be rejected before reaching the backend:
+// packets.ErrBanned for banned IPs and locked out clients, packets.ErrServerBusy for rate limited IPs and
+// the previous reason code for a secret that was just rejected.
+func (g *LoginGuard) Check(clientId, username, ip, secret string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	host := g.host(ip, now)
+	if now.Before(host.bannedUntil) {
+		return fmt.Errorf("%w: %s is banned", packets.ErrBanned, ip)
+	}
+
+	if *rateLimit > 0 {
+		host.tokens = min(host.tokens+now.Sub(host.refilled).Seconds()**rateLimit, float64(max(*rateBurst, 1)))
+		host.refilled = now
+		if host.tokens < 1 {
+			return fmt.Errorf("%w: too many connection attempts from %s", packets.ErrServerBusy, ip)
+		}
+		host.tokens--
+	}
+
+	login := g.logins[loginKey(clientId, username, ip)]
+	if login == nil {
+		return nil
+	}
+
+	if now.Before(login.lockedUntil) {
+		return fmt.Errorf("%w: locked out after %d failed attempts", packets.ErrBanned, login.failures)
+	}
+
+	if *negativeTTL > 0 && now.Sub(login.lastFailure) < *negativeTTL && login.secretHash == string(hashSecret(nil, secret)) {
+		return fmt.Errorf("%w: secret was rejected recently", login.code)
+	}
+
+	return nil
+}
+
+// Failed records a failed authentication, locking the client out once the threshold is reached. Failures
+// caused by an unavailable backend are not counted.
+func (g *LoginGuard) Failed(clientId, username, ip, secret string, err error) {
+	code := ReasonCode(err)
+	if code == packets.ErrServerUnavailable || code == packets.ErrServerBusy {
+		return
+	}
+
+	if event := g.recordFailure(clientId, username, ip, secret, code); event != nil {
+		log.Println("auth lockout:", clientId, username, ip, "failures", event.Failures, "banned", event.Banned)
+		websockets.SendMessage(websockets.MqttAuthLockout, event)
+	}
+}
+
+// recordFailure counts a failed authentication and returns the event of the lockout it starts, if any.
+func (g *LoginGuard) recordFailure(clientId, username, ip, secret string, code packets.Code) *AuthLockoutEvent {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	key := loginKey(clientId, username, ip)
+	login := g.logins[key]
+	if login == nil {
+		login = &failedLogin{}
+		g.logins[key] = login
+	}
+
+	login.failures++
+	login.lastFailure = now
+	login.secretHash = string(hashSecret(nil, secret))
+	login.code = code
+
+	if *lockoutThreshold <= 0 || login.failures < *lockoutThreshold {
+		return nil
+	}
+
+	// Every failure past the threshold doubles the lockout.
+	lockout := min(*lockoutBase<<min(login.failures-*lockoutThreshold, 20), *lockoutMax)
+	if lockout <= 0 {
+		lockout = *lockoutMax
+	}
+	login.lockedUntil = now.Add(lockout)
+
+	event := AuthLockoutEvent{
+		ClientID:    clientId,
+		Username:    username,
+		RemoteIP:    ip,
+		Failures:    login.failures,
+		LockedUntil: uint64(login.lockedUntil.UnixMilli()),
+		Timestamp:   uint64(now.UnixMilli()),
+	}
+
+	// IPs that keep getting locked out are banned altogether.
+	host := g.host(ip, now)
+	if now.Sub(host.lastLockout) > *banDuration {
+		host.lockouts = 0
+	}
+	host.lockouts++
+	host.lastLockout = now
+
+	if *banThreshold > 0 && host.lockouts >= *banThreshold {
+		host.bannedUntil = now.Add(*banDuration)
+		event.Banned = true
+		event.LockedUntil = uint64(host.bannedUntil.UnixMilli())
+	}
+
+	return &event
+}
+
+// Succeeded forgets the failed authentications of a client that authenticated.
+func (g *LoginGuard) Succeeded(clientId, username, ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.logins, loginKey(clientId, username, ip))
+}
+
+// host returns the state of an IP, creating it with a full rate limiter bucket. The caller must hold the lock.
+func (g *LoginGuard) host(ip string, now time.Time) *remoteHost {
+	host := g.hosts[ip]
+	if host == nil {
+		host = &remoteHost{tokens: float64(max(*rateBurst, 1)), refilled: now}
+		g.hosts[ip] = host
+	}
+
+	return host
+}
+
+// cleanup periodically forgets failures, lockouts and bans that are over.
+func (g *LoginGuard) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.mutex.Lock()
+			now := time.Now()
+			for key, login := range g.logins {
+				if now.After(login.lockedUntil) && now.Sub(login.lastFailure) > *failureWindow {
+					delete(g.logins, key)
+				}
+			}
+			for ip, host := range g.hosts {
+				refilled := *rateLimit <= 0 || now.Sub(host.refilled).Seconds()**rateLimit >= float64(*rateBurst)
+				if refilled && now.After(host.bannedUntil) && now.Sub(host.lastLockout) > *banDuration {
+					delete(g.hosts, ip)
+				}
+			}
+			g.mutex.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loginKey identifies the failed authentications of a client ID and username from an IP.
+func loginKey(clientId, username, ip string) string {
+	return clientId + "::" + username + "::" + ip
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// Define flags for the team namespace (tenancy) mode.
+var (
+	teamNamespace = flag.String("team-namespace", "", "Topic prefix template mounting each client's topics under its team, e.g. teams/{team_id}. Empty disables tenancy")
+)
+
+// sharedPrefix marks MQTT v5 shared subscription filters ($share/{group}/{filter}).
+const sharedPrefix = "$share/"
+
+// NamespaceEnabled reports whether client topics are mounted under a per-team prefix.
+func NamespaceEnabled() bool {
+	return *teamNamespace != ""
+}
+
+// Namespace returns the topic prefix (with trailing slash) the token's topics are mounted under.
+func (t *AuthenticatedToken) Namespace() string {
+	if t == nil || !NamespaceEnabled() {
+		return ""
+	}
+
+	prefix := strings.ReplaceAll(*teamNamespace, "{team_id}", strconv.FormatUint(t.TeamID, 10))
+	return strings.TrimSuffix(prefix, "/") + "/"
+}
+
+// MountTopic converts a client-visible topic or filter into the internal topic used by the broker.
+func (t *AuthenticatedToken) MountTopic(topic string) string {
+	namespace := t.Namespace()
+	if namespace == "" {
+		return topic
+	}
+
+	share, filter := splitShared(topic)
+	return share + namespace + filter
+}
+
+// UnmountTopic converts an internal topic or filter back into the one visible to the client.
+// The second return value is false if the topic is outside the token's namespace.
+func (t *AuthenticatedToken) UnmountTopic(topic string) (string, bool) {
+	namespace := t.Namespace()
+	if namespace == "" {
+		return topic, true
+	}
+
+	share, filter := splitShared(topic)
+	if !strings.HasPrefix(filter, namespace) {
+		return topic, false
+	}
+
+	return share + strings.TrimPrefix(filter, namespace), true
+}
+
+// splitShared splits a shared subscription filter into its $share/{group}/ prefix and the actual filter.
+func splitShared(filter string) (string, string) {
+	if !strings.HasPrefix(filter, sharedPrefix) {
+		return "", filter
+	}
+
+	group, rest, found := strings.Cut(strings.TrimPrefix(filter, sharedPrefix), "/")
+	if !found {
+		return "", filter
+	}
+
+	return sharedPrefix + group + "/", rest
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Define flags for the panel authentication backend.
+var (
+	remotePath     = flag.String("auth-url", "http://mqtt-panel.test/api/mqtt/auth", "URL of the remote authentication service")
+	authTimeout    = flag.Duration("auth-timeout", 10*time.Second, "Timeout of a single request to the panel")
+	authConcurrent = flag.Int("auth-max-concurrency", 32, "Maximum number of simultaneous requests to the panel")
+)
+
+// panelSlots bounds the number of simultaneous requests to the panel, shared by every panel client.
+var panelSlots = sync.OnceValue(func() chan struct{} {
+	return make(chan struct{}, max(*authConcurrent, 1))
+})
+
+// authResponse is the body returned by the remote authentication service on success.
+type authResponse struct {
+	TeamID       uint64            `json:"team_id"`
+	MqttClientID uint64            `json:"mqtt_client_id"`
+	ApiTokenID   uint64            `json:"api_token_id"`
+	Topics       *TopicPermissions `json:"topics"`
+	ExpiresAt    unixTime          `json:"expires_at"`  // Optional absolute expiry of the token
+	TTLSeconds   uint64            `json:"ttl_seconds"` // Optional lifetime of the token, overriding the flag
+	Quotas       *TeamQuotas       `json:"quotas"`      // Optional quotas of the team, overriding the configured ones
+}
+
+// unixTime is a timestamp sent either as UNIX seconds or as an RFC 3339 string.
+type unixTime uint64
+
+// UnmarshalJSON accepts both forms of a timestamp.
+func (u *unixTime) UnmarshalJSON(data []byte) error {
+	var seconds uint64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*u = unixTime(seconds)
+		return nil
+	}
+
+	var formatted *string
+	if err := json.Unmarshal(data, &formatted); err != nil {
+		return err
+	}
+
+	if formatted == nil || *formatted == "" {
+		*u = 0
+		return nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, *formatted)
+	if err != nil {
+		return err
+	}
+
+	*u = unixTime(parsed.Unix())
+	return nil
+}
+
+// PanelAuthenticator validates credentials by posting them to the panel's authentication endpoint.
+type PanelAuthenticator struct {
+	URL    string       // Authentication endpoint of the panel
+	Client *http.Client // HTTP client used for the requests
+}
+
+// NewPanelAuthenticator creates a panel backend posting to the given URL.
+func NewPanelAuthenticator(url string) *PanelAuthenticator {
+	return &PanelAuthenticator{
+		URL: url,
+		// Set up a signing HTTP client with a timeout to prevent indefinite hangs.
+		Client: NewPanelClient(*authTimeout),
+	}
+}
+
+// Authenticate makes a remote call to validate credentials and returns a token.
+func (a *PanelAuthenticator) Authenticate(ctx context.Context, credentials Credentials) (*AuthenticatedToken, error) {
+	// Send an HTTP POST request with the provided credentials.
+	return a.requestToken(ctx, a.URL, map[string]string{
+		"client_id":  credentials.ClientID,
+		"api_key":    credentials.Username,
+		"api_secret": credentials.Password,
+	})
+}
+
+// requestToken posts the payload to a panel endpoint and creates a token from its response, retrying
+// transport errors and 5xx responses.
+func (a *PanelAuthenticator) requestToken(ctx context.Context, url string, payload any) (*AuthenticatedToken, error) {
+	var responseContent authResponse
+	if err := a.request(ctx, url, payload, &responseContent); err != nil {
+		return nil, err
+	}
+
+	return responseContent.token(), nil
+}
+
+// request posts the payload to a panel endpoint and decodes the response body into out, retrying
+// transport errors and 5xx responses.
+func (a *PanelAuthenticator) request(ctx context.Context, url string, payload any, out any) error {
+	_, err := withRetry(ctx, func() (struct{}, error) {
+		return struct{}{}, a.attempt(ctx, url, payload, out)
+	})
+
+	return err
+}
+
+// attempt makes a single request, waiting for a free slot of the panel request pool.
+func (a *PanelAuthenticator) attempt(ctx context.Context, url string, payload any, out any) error {
+	select {
+	case panelSlots() <- struct{}{}:
+		defer func() { <-panelSlots() }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Fail fast without contacting the panel while it is known to be down.
+	breaker := panelBreaker()
+	if err := breaker.Allow(); err != nil {
+		return err
+	}
+
+	response, err := a.sendRequest(ctx, url, payload)
+	if err != nil {
+		breaker.Failure(err)
+		return retryable(err) // Transport errors may succeed on a later attempt.
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer response.Body.Close() // Ensure the response body is closed to prevent memory leaks.
+
+	// Server errors are retried, client errors such as 401 or 422 never are.
+	if response.StatusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("auth service responded with status %d", response.StatusCode)
+		breaker.Failure(err)
+		return retryable(err)
+	}
+
+	breaker.Success()
+
+	// Only 2xx responses authenticate, anything else carries the reason of the rejection.
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return newAuthError(response)
+	}
+
+	// Parse the response body.
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// token creates a new AuthenticatedToken using the data from the response.
+func (r *authResponse) token() *AuthenticatedToken {
+	token := &AuthenticatedToken{
+		TeamID:       r.TeamID,
+		MqttClientID: r.MqttClientID,
+		ApiTokenID:   r.ApiTokenID,
+		ExpiresAt:    uint64(r.ExpiresAt),
+		Lifetime:     r.TTLSeconds,
+		Permissions:  r.Topics,
+		TeamQuotas:   r.Quotas,
+	}
+	token.TTL = token.nextTTL()
+
+	return token
+}
+
+// sendRequest sends a JSON POST request to a panel endpoint.
+func (a *PanelAuthenticator) sendRequest(ctx context.Context, url string, payload any) (*http.Response, error) {
+	// Create the JSON payload for the request.
+	requestData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err // Return an error if JSON encoding fails.
+	}
+
+	// Initialize a new HTTP request with JSON headers.
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(requestData))
+	if err != nil {
+		return nil, err // Return an error if request creation fails.
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	response, err := a.Client.Do(request)
+	if err != nil {
+		return nil, err // Return an error if the request execution fails.
+	}
+
+	return response, nil // Return the HTTP response for further processing.
+}
@@ -0,0 +1,52 @@
+package services
+
+import "flag"
+
+// Define flags for per-team quotas.
+var (
+	teamQuotasFile = flag.String("team-quotas-file", "", "YAML or JSON file with default and per-team quotas, used when the auth response carries none")
+)
+
+// TeamQuotas limits the resources a team may use. Zero values are unlimited.
+type TeamQuotas struct {
+	MaxConnections    int     `json:"max_connections" yaml:"max_connections"`         // Concurrently connected clients
+	MaxSubscriptions  int     `json:"max_subscriptions" yaml:"max_subscriptions"`     // Subscriptions of the connected clients
+	MessagesPerSecond float64 `json:"messages_per_second" yaml:"messages_per_second"` // Published messages per second
+	BytesPerDay       int64   `json:"bytes_per_day" yaml:"bytes_per_day"`             // Published payload bytes per UTC day
+}
+
+// teamQuotasConfig is the content of the team quotas file.
+type teamQuotasConfig struct {
+	Default *TeamQuotas           `yaml:"default"` // Quotas of teams without an entry
+	Teams   map[uint64]TeamQuotas `yaml:"teams"`   // Quotas by team ID
+}
+
+// configuredQuotas holds the loaded team quotas file, empty if none is configured.
+var configuredQuotas teamQuotasConfig
+
+// loadTeamQuotas reads the team quotas file, if configured.
+func loadTeamQuotas() error {
+	if *teamQuotasFile == "" {
+		return nil
+	}
+
+	return loadConfigFile(*teamQuotasFile, &configuredQuotas)
+}
+
+// Quotas returns the quotas of the token's team: those sent by the backend, else those configured for the
+// team, else the configured default. It returns nil if the team is unlimited.
+func (t *AuthenticatedToken) Quotas() *TeamQuotas {
+	if t == nil {
+		return nil
+	}
+
+	if t.TeamQuotas != nil {
+		return t.TeamQuotas
+	}
+
+	if quotas, ok := configuredQuotas.Teams[t.TeamID]; ok {
+		return &quotas
+	}
+
+	return configuredQuotas.Default
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define flags for signing requests to the panel.
+var (
+	panelSigningSecret = flag.String("panel-signing-secret", "", "Shared secret signing every request to the panel with HMAC-SHA256, empty to send unsigned requests")
+	signatureTolerance = flag.Duration("panel-signature-tolerance", 5*time.Minute, "Maximum age of a signed request's timestamp before it is treated as a replay")
+)
+
+// Headers carrying the signature of a request.
+const (
+	TimestampHeader = "X-Broker-Timestamp" // UNIX seconds the request was signed at
+	SignatureHeader = "X-Broker-Signature" // Hex encoded HMAC-SHA256 of the canonical request
+)
+
+// Errors returned when a signed request is rejected.
+var (
+	ErrMissingSignature = errors.New("request is not signed")
+	ErrStaleSignature   = errors.New("request timestamp is outside the tolerance")
+	ErrInvalidSignature = errors.New("invalid request signature")
+)
+
+// RequestSigner signs HTTP requests with a shared secret. The signature is the HMAC-SHA256 of the method,
+// the request URI, the timestamp and the hex encoded SHA-256 of the body, joined by newlines.
+type RequestSigner struct {
+	Secret    []byte        // Shared secret of the broker and the panel
+	Tolerance time.Duration // Maximum clock difference accepted when verifying, to reject replayed requests
+}
+
+// panelSigner signs every request to the panel, nil if no secret is configured.
+var panelSigner = sync.OnceValue(func() *RequestSigner {
+	if *panelSigningSecret == "" {
+		return nil
+	}
+
+	return &RequestSigner{Secret: []byte(*panelSigningSecret), Tolerance: *signatureTolerance}
+})
+
+// Sign adds the timestamp and signature headers to the request with the given body.
+func (s *RequestSigner) Sign(request *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, s.signature(request.Method, request.URL.RequestURI(), timestamp, body))
+}
+
+// Verify checks the signature headers of a request with the given body and rejects timestamps outside
+// the tolerance.
+func (s *RequestSigner) Verify(request *http.Request, body []byte) error {
+	timestamp := request.Header.Get(TimestampHeader)
+	signature := request.Header.Get(SignatureHeader)
+	if timestamp == "" || signature == "" {
+		return ErrMissingSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+
+	if age := time.Since(time.Unix(seconds, 0)); age > s.Tolerance || age < -s.Tolerance {
+		return ErrStaleSignature
+	}
+
+	expected := s.signature(request.Method, request.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// signature computes the hex encoded HMAC-SHA256 of the canonical request.
+func (s *RequestSigner) signature(method, uri, timestamp string, body []byte) string {
+	digest := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, s.Secret)
+	_, _ = io.WriteString(mac, method+"\n"+uri+"\n"+timestamp+"\n"+hex.EncodeToString(digest[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SigningTransport signs every request before passing it to the underlying transport.
+type SigningTransport struct {
+	Signer *RequestSigner    // Signer of the requests
+	Base   http.RoundTripper // Transport sending the signed requests, http.DefaultTransport if nil
+}
+
+// RoundTrip signs a copy of the request, timestamped when it is sent, so retries are signed anew.
+func (t *SigningTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		_ = request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signed := request.Clone(request.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	t.Signer.Sign(signed, body)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return base.RoundTrip(signed)
+}
+
+// NewPanelClient creates an HTTP client for requests to the panel, signing them if a secret is configured.
+func NewPanelClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if signer := panelSigner(); signer != nil {
+		client.Transport = &SigningTransport{Signer: signer}
+	}
+
+	return client
+}
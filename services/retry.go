@@ -0,0 +1,69 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Define flags for retrying requests to the panel.
+var (
+	authRetries      = flag.Int("auth-retries", 3, "Number of retries of panel requests failing with transport errors or 5xx responses")
+	authRetryBackoff = flag.Duration("auth-retry-backoff", 200*time.Millisecond, "Base delay of the exponential backoff between panel request retries")
+	authRetryMax     = flag.Duration("auth-retry-max-backoff", 5*time.Second, "Maximum delay between panel request retries")
+)
+
+// retryableError marks a failure that may succeed when the request is repeated.
+type retryableError struct {
+	err error
+}
+
+// Error returns the message of the wrapped error.
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// retryable marks an error as worth retrying.
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not retryable, or the retries run out.
+// Attempts are separated by a jittered exponential backoff.
+func withRetry[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	result, err := fn()
+	for attempt := 1; attempt <= *authRetries && errors.As(err, new(*retryableError)); attempt++ {
+		select {
+		case <-time.After(backoff(attempt, *authRetryBackoff, *authRetryMax)):
+		case <-ctx.Done():
+			return result, fmt.Errorf("%w (last error: %s)", ctx.Err(), err)
+		}
+
+		result, err = fn()
+	}
+
+	return result, err
+}
+
+// backoff returns the delay before the given retry attempt: half of the exponential delay plus a random jitter
+// of up to the other half, so clients failing together don't retry in lockstep.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base << (attempt - 1)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+
+	if delay < 2 {
+		return delay
+	}
+
+	return delay/2 + rand.N(delay/2)
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ErrEmptyRevocation is returned for a revocation that would match every cached token.
+var ErrEmptyRevocation = errors.New("revocation needs an api_token_id, mqtt_client_id or team_id")
+
+// ErrRevoked is the reason clients are disconnected with when their credentials were revoked.
+var ErrRevoked = packets.Code{Code: packets.ErrAdministrativeAction.Code, Reason: "credentials revoked"}
+
+// RevocationFilter selects the cached tokens to revoke. Every non-zero field must match.
+type RevocationFilter struct {
+	ApiTokenID   uint64 `json:"api_token_id"`
+	MqttClientID uint64 `json:"mqtt_client_id"`
+	TeamID       uint64 `json:"team_id"`
+}
+
+// Matches reports whether the token is selected by the filter.
+func (f RevocationFilter) Matches(token *AuthenticatedToken) bool {
+	return (f.ApiTokenID == 0 || f.ApiTokenID == token.ApiTokenID) &&
+		(f.MqttClientID == 0 || f.MqttClientID == token.MqttClientID) &&
+		(f.TeamID == 0 || f.TeamID == token.TeamID)
+}
+
+// Revoke removes every cached token selected by the filter and returns the authentication keys
+// (client ID and username) they were cached under.
+func (s *AuthService) Revoke(filter RevocationFilter) ([]string, error) {
+	if filter == (RevocationFilter{}) {
+		return nil, ErrEmptyRevocation
+	}
+
+	revoked := s.AuthenticatedList.DeleteFunc(func(_ string, token *AuthenticatedToken) bool {
+		return filter.Matches(token)
+	})
+
+	// Cached SCRAM material would grant the revoked token again.
+	s.scram.deleteFunc(filter.Matches)
+
+	// Revoked clients admitted during an outage must not be re-validated.
+	s.stale.mutex.Lock()
+	for _, authKey := range revoked {
+		delete(s.stale.credentials, authKey)
+	}
+	s.stale.mutex.Unlock()
+
+	return revoked, nil
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Define flags for SCRAM-SHA-256 enhanced authentication.
+var (
+	scramAuth   = flag.Bool("scram-auth", false, "Accept MQTT v5 enhanced authentication with SCRAM-SHA-256")
+	scramSource = flag.String("scram-source", "panel", "Source of SCRAM credential material: panel or file")
+	scramURL    = flag.String("scram-url", "http://mqtt-panel.test/api/mqtt/scram", "Panel URL returning the SCRAM credential material of a client")
+)
+
+// ScramSHA256 is the MQTT v5 authentication method name of SCRAM-SHA-256.
+const ScramSHA256 = "SCRAM-SHA-256"
+
+// ErrScramMessage is returned for SCRAM messages that do not follow RFC 5802.
+var ErrScramMessage = errors.New("malformed scram message")
+
+// ScramSecret is the salted credential material of a client, from which the secret cannot be recovered.
+type ScramSecret struct {
+	Salt       string `json:"salt" yaml:"salt"`             // Base64 encoded salt
+	Iterations int    `json:"iterations" yaml:"iterations"` // PBKDF2 iteration count
+	StoredKey  string `json:"stored_key" yaml:"stored_key"` // Base64 encoded SHA-256 of the client key
+	ServerKey  string `json:"server_key" yaml:"server_key"` // Base64 encoded server key
+}
+
+// ScramCredential is the decoded credential material of a client together with the token it is granted
+// once it proved knowledge of the secret.
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+	Token      *AuthenticatedToken
+}
+
+// ScramSource returns the credential material of a client, or ErrInvalidCredentials if it has none.
+type ScramSource interface {
+	ScramCredential(ctx context.Context, clientId, username string) (*ScramCredential, error)
+}
+
+// ScramExchange is the server state of a SCRAM exchange between the first and the final client message.
+type ScramExchange struct {
+	ClientID string // Client ID the exchange authenticates
+	Username string // Username sent in the client-first message
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	credential      *ScramCredential
+}
+
+// scramCache caches the credential material of clients until their token expires.
+type scramCache struct {
+	mutex       sync.Mutex
+	credentials map[string]*ScramCredential
+}
+
+// ScramEnabled reports whether SCRAM-SHA-256 enhanced authentication is accepted.
+func ScramEnabled() bool {
+	return *scramAuth
+}
+
+// NewScramSource creates the credential material source with the given name, configured from flags.
+func NewScramSource(name string) (ScramSource, error) {
+	switch name {
+	case "panel":
+		return &PanelScramSource{Panel: NewPanelAuthenticator(*scramURL)}, nil
+	case "file":
+		return NewFileAuthenticator(*credentialsFile)
+	default:
+		return nil, fmt.Errorf("unknown scram source %q", name)
+	}
+}
+
+// NewScramSecret derives the credential material of a secret, for provisioning credential files and the panel.
+func NewScramSecret(secret string, iterations int) (ScramSecret, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return ScramSecret{}, err
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(secret), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return ScramSecret{
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Iterations: iterations,
+		StoredKey:  base64.StdEncoding.EncodeToString(storedKey[:]),
+		ServerKey:  base64.StdEncoding.EncodeToString(scramHMAC(saltedPassword, "Server Key")),
+	}, nil
+}
+
+// decode converts the base64 encoded material into a credential granting the token.
+func (s ScramSecret) decode(token *AuthenticatedToken) (*ScramCredential, error) {
+	credential := &ScramCredential{Iterations: s.Iterations, Token: token}
+
+	var err error
+	if credential.Salt, err = base64.StdEncoding.DecodeString(s.Salt); err != nil {
+		return nil, fmt.Errorf("decode scram salt: %w", err)
+	}
+	if credential.StoredKey, err = base64.StdEncoding.DecodeString(s.StoredKey); err != nil {
+		return nil, fmt.Errorf("decode scram stored key: %w", err)
+	}
+	if credential.ServerKey, err = base64.StdEncoding.DecodeString(s.ServerKey); err != nil {
+		return nil, fmt.Errorf("decode scram server key: %w", err)
+	}
+
+	if credential.Iterations < 4096 || len(credential.StoredKey) != sha256.Size || len(credential.ServerKey) != sha256.Size {
+		return nil, errors.New("invalid scram credential material")
+	}
+
+	return credential, nil
+}
+
+// PanelScramSource fetches credential material from the panel.
+type PanelScramSource struct {
+	Panel *PanelAuthenticator
+}
+
+// ScramCredential requests the credential material and token of a client from the panel.
+func (p *PanelScramSource) ScramCredential(ctx context.Context, clientId, username string) (*ScramCredential, error) {
+	var responseContent struct {
+		authResponse
+		ScramSecret
+	}
+
+	err := p.Panel.request(ctx, p.Panel.URL, map[string]string{
+		"client_id": clientId,
+		"api_key":   username,
+	}, &responseContent)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseContent.ScramSecret.decode(responseContent.authResponse.token())
+}
+
+// ScramCredential returns the credential material of the first file entry matching the client ID and username.
+func (a *FileAuthenticator) ScramCredential(_ context.Context, clientId, username string) (*ScramCredential, error) {
+	for _, entry := range a.Credentials {
+		if entry.Username != username || entry.Scram == nil {
+			continue
+		}
+
+		if entry.ClientID != "" && entry.ClientID != clientId {
+			continue
+		}
+
+		return entry.Scram.decode(entry.token())
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// StartScram handles the client-first message of an exchange and returns the server-first message. A non-empty
+// username must match the one in the message. Unknown clients receive made-up material, so they cannot be told
+// apart from a wrong secret.
+func (s *AuthService) StartScram(clientId, username string, clientFirst []byte) (*ScramExchange, []byte, error) {
+	exchange, clientNonce, err := parseClientFirst(clientId, string(clientFirst))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if username != "" && username != exchange.Username {
+		return nil, nil, fmt.Errorf("%w: scram username does not match", ErrInvalidCredentials)
+	}
+
+	exchange.credential, err = s.scramCredential(clientId, exchange.Username)
+	if errors.Is(err, ErrInvalidCredentials) {
+		exchange.credential, err = unknownScramCredential(exchange.Username)
+	}
+	if err != nil {
+		log.Println("scram: fetching credential:", err)
+		return nil, nil, err
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err = rand.Read(serverNonce); err != nil {
+		return nil, nil, err
+	}
+
+	exchange.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	exchange.serverFirst = "r=" + exchange.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(exchange.credential.Salt) +
+		",i=" + strconv.Itoa(exchange.credential.Iterations)
+
+	return exchange, []byte(exchange.serverFirst), nil
+}
+
+// FinishScram verifies the client-final message and returns the server-final message. On success the client's
+// token is cached, so its topic access is authorized like that of password authenticated clients.
+func (s *AuthService) FinishScram(exchange *ScramExchange, clientFinal []byte) ([]byte, error) {
+	withoutProof, encodedProof, found := strings.Cut(string(clientFinal), ",p=")
+	if !found {
+		return nil, ErrScramMessage
+	}
+
+	attributes := scramAttributes(withoutProof)
+	binding, err := base64.StdEncoding.DecodeString(attributes["c"])
+	if err != nil || string(binding) != exchange.gs2Header || attributes["r"] != exchange.nonce {
+		return nil, ErrScramMessage
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(encodedProof)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrScramMessage
+	}
+
+	credential := exchange.credential
+	authMessage := exchange.clientFirstBare + "," + exchange.serverFirst + "," + withoutProof
+
+	// Recover the client key from the proof and check it against the stored key.
+	clientSignature := scramHMAC(credential.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if credential.Token == nil || subtle.ConstantTimeCompare(storedKey[:], credential.StoredKey) != 1 {
+		return nil, fmt.Errorf("%w: invalid scram proof", ErrInvalidCredentials)
+	}
+
+	s.AuthenticatedList.Set(exchange.ClientID+"::"+exchange.Username, credential.Token)
+
+	serverSignature := scramHMAC(credential.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// scramCredential returns the cached credential material of a client, fetching it from the source if it is
+// missing or its token expired.
+func (s *AuthService) scramCredential(clientId, username string) (*ScramCredential, error) {
+	authKey := clientId + "::" + username
+
+	s.scram.mutex.Lock()
+	credential := s.scram.credentials[authKey]
+	s.scram.mutex.Unlock()
+
+	if credential != nil && !credential.Token.Expired(unixNow()) {
+		return credential, nil
+	}
+
+	if s.ScramSource == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	credential, err := s.ScramSource.ScramCredential(context.Background(), clientId, username)
+	if err != nil {
+		return nil, err
+	}
+
+	s.scram.mutex.Lock()
+	defer s.scram.mutex.Unlock()
+
+	if s.scram.credentials == nil {
+		s.scram.credentials = make(map[string]*ScramCredential)
+	}
+	s.scram.credentials[authKey] = credential
+	return credential, nil
+}
+
+// deleteFunc removes every cached credential whose token fn returns true for.
+func (c *scramCache) deleteFunc(fn func(token *AuthenticatedToken) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, credential := range c.credentials {
+		if fn(credential.Token) {
+			delete(c.credentials, key)
+		}
+	}
+}
+
+// unknownScramSaltKey returns the random key the made-up salts of unknown clients are derived from, generated
+// once per run.
+var unknownScramSaltKey = sync.OnceValues(func() ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+})
+
+// unknownScramCredential makes up material for a client without credentials, which no proof matches. The salt
+// is derived from the username, so repeated attempts see the same salt as they would for a known client.
+func unknownScramCredential(username string) (*ScramCredential, error) {
+	key, err := unknownScramSaltKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScramCredential{
+		Salt:       scramHMAC(key, username)[:16],
+		Iterations: 4096,
+		StoredKey:  make([]byte, sha256.Size),
+		ServerKey:  make([]byte, sha256.Size),
+	}, nil
+}
+
+// ScramUsername returns the username of a client-first message, so attempts can be checked before any
+// credential material is fetched.
+func ScramUsername(clientFirst []byte) (string, error) {
+	exchange, _, err := parseClientFirst("", string(clientFirst))
+	if err != nil {
+		return "", err
+	}
+
+	return exchange.Username, nil
+}
+
+// parseClientFirst parses the client-first message into a new exchange and returns the client nonce.
+func parseClientFirst(clientId, message string) (*ScramExchange, string, error) {
+	// The GS2 header holds the channel binding flag and an optional authorization identity.
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, "", fmt.Errorf("%w: channel binding is not supported", ErrScramMessage)
+	}
+
+	attributes := scramAttributes(parts[2])
+	username := scramUnescape(attributes["n"])
+	if username == "" || attributes["r"] == "" {
+		return nil, "", ErrScramMessage
+	}
+
+	if parts[1] != "" && scramUnescape(strings.TrimPrefix(parts[1], "a=")) != username {
+		return nil, "", fmt.Errorf("%w: authorization identity is not supported", ErrScramMessage)
+	}
+
+	return &ScramExchange{
+		ClientID:        clientId,
+		Username:        username,
+		gs2Header:       parts[0] + "," + parts[1] + ",",
+		clientFirstBare: parts[2],
+	}, attributes["r"], nil
+}
+
+// scramAttributes splits a SCRAM message into its single letter attributes.
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if name, value, found := strings.Cut(attribute, "="); found && len(name) == 1 {
+			attributes[name] = value
+		}
+	}
+
+	return attributes
+}
+
+// scramUnescape decodes the commas and equal signs escaped in a SCRAM username.
+func scramUnescape(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+// scramHMAC computes the HMAC-SHA256 of the message with the key.
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// secretSaltSize is the length in bytes of the random salt hashed together with each secret.
+const secretSaltSize = 16
+
+// hashSecret returns the salted SHA-256 hash of a secret.
+func hashSecret(salt []byte, secret string) []byte {
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(secret))
+	return hash.Sum(nil)
+}
+
+// bindSecret stores a salted hash of the secret that produced the token, so cache hits can be verified.
+func (t *AuthenticatedToken) bindSecret(secret string) error {
+	salt := make([]byte, secretSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	t.SecretSalt = salt
+	t.SecretHash = hashSecret(salt, secret)
+	return nil
+}
+
+// MatchesSecret reports, in constant time, whether the secret is the one that produced the token.
+func (t *AuthenticatedToken) MatchesSecret(secret string) bool {
+	if len(t.SecretHash) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(t.SecretHash, hashSecret(t.SecretSalt, secret)) == 1
+}
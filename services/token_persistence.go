@@ -0,0 +1,229 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Define flags for the persistent token cache.
+var (
+	cacheFile = flag.String("auth-cache-file", "", "File persisting authenticated tokens across restarts, empty to keep them in memory only")
+)
+
+// tokensBucket is the bbolt bucket tokens are stored in by authentication key.
+var tokensBucket = []byte("tokens")
+
+// TokenPersistence writes cached tokens through to an embedded bbolt file, so a restarted broker does not
+// have to authenticate every client against the backend again. Secrets are only stored as salted hashes.
+type TokenPersistence struct {
+	Path string // Path of the bbolt file
+
+	mutex sync.RWMutex // Write-through holds the read lock, compaction the write lock while it swaps files
+	db    *bbolt.DB
+}
+
+// OpenTokenPersistence opens or creates the bbolt file at path.
+func OpenTokenPersistence(path string) (*TokenPersistence, error) {
+	db, err := openTokenDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPersistence{Path: path, db: db}, nil
+}
+
+// openTokenDB opens the bbolt file and creates the tokens bucket. A file locked by another broker fails
+// after a second instead of blocking startup.
+func openTokenDB(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokensBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Load adds every persisted token that has not expired by now to the store, removing expired ones from the
+// file, and returns the number of loaded tokens. It must be called before the store writes through to p.
+func (p *TokenPersistence) Load(store *TokenStore, now uint64) (int, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	loaded := 0
+	err := p.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		cursor := bucket.Cursor()
+
+		for key, value := cursor.First(); key != nil; {
+			token := new(AuthenticatedToken)
+			if err := json.Unmarshal(value, token); err != nil || token.Expired(now) {
+				if err = cursor.Delete(); err != nil {
+					return err
+				}
+				// Deleting moves the cursor to the next entry.
+				key, value = cursor.Seek(key)
+				continue
+			}
+
+			store.Set(string(key), token)
+			loaded++
+			key, value = cursor.Next()
+		}
+
+		return nil
+	})
+
+	return loaded, err
+}
+
+// Put writes the token through to the file. Concurrent writes are batched into a single transaction.
+func (p *TokenPersistence) Put(key string, token *AuthenticatedToken) {
+	value, err := json.Marshal(token.snapshot())
+	if err != nil {
+		log.Println("token cache: persist:", err)
+		return
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.db == nil {
+		return
+	}
+
+	err = p.db.Batch(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(key), value)
+	})
+	if err != nil {
+		log.Println("token cache: persist:", err)
+	}
+}
+
+// Delete removes the tokens stored under the keys from the file.
+func (p *TokenPersistence) Delete(keys ...string) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.db == nil {
+		return
+	}
+
+	err := p.db.Batch(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Println("token cache: delete:", err)
+	}
+}
+
+// Compact rewrites the file with the tokens currently in the store, which drops expired entries, persists
+// slid TTLs and releases the space bbolt keeps after deletes.
+func (p *TokenPersistence) Compact(store *TokenStore) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.db == nil {
+		return errors.New("token cache file is closed")
+	}
+
+	compactPath := p.Path + ".compact"
+	_ = os.Remove(compactPath)
+
+	compacted, err := openTokenDB(compactPath)
+	if err != nil {
+		return err
+	}
+
+	err = compacted.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+
+		var err error
+		store.Range(func(key string, token *AuthenticatedToken) bool {
+			var value []byte
+			if value, err = json.Marshal(token.snapshot()); err == nil {
+				err = bucket.Put([]byte(key), value)
+			}
+			return err == nil
+		})
+
+		return err
+	})
+	if closeErr := compacted.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(compactPath)
+		return err
+	}
+
+	if err = p.db.Close(); err != nil {
+		return err
+	}
+	p.db = nil
+
+	if err = os.Rename(compactPath, p.Path); err != nil {
+		log.Println("token cache: replace file:", err)
+	}
+
+	// Reopen the current file, compacted or not, so write-through keeps working.
+	db, err := openTokenDB(p.Path)
+	if err != nil {
+		return err
+	}
+
+	p.db = db
+	return nil
+}
+
+// Close closes the file.
+func (p *TokenPersistence) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.db == nil {
+		return nil
+	}
+
+	err := p.db.Close()
+	p.db = nil
+	return err
+}
+
+// snapshot copies the token with its TTL loaded atomically, as it may be refreshed concurrently.
+func (t *AuthenticatedToken) snapshot() AuthenticatedToken {
+	return AuthenticatedToken{
+		TeamID:       t.TeamID,
+		MqttClientID: t.MqttClientID,
+		ApiTokenID:   t.ApiTokenID,
+		TTL:          atomic.LoadUint64(&t.TTL),
+		LastUsed:     atomic.LoadUint64(&t.LastUsed),
+		ExpiresAt:    t.ExpiresAt,
+		Lifetime:     t.Lifetime,
+		Permissions:  t.Permissions,
+		TeamQuotas:   t.TeamQuotas,
+		SecretSalt:   t.SecretSalt,
+		SecretHash:   t.SecretHash,
+		Certificate:  t.Certificate,
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenStoreShards is the number of independently locked partitions of a TokenStore.
+const tokenStoreShards = 32
+
+// TokenStore is a concurrency-safe cache of authenticated tokens, sharded to reduce lock contention
+// between client goroutines.
+type TokenStore struct {
+	shards      [tokenStoreShards]*tokenShard
+	persistence *TokenPersistence // Writes changes through to disk, nil to keep tokens in memory only
+}
+
+// tokenShard is a single partition of the TokenStore guarded by its own lock.
+type tokenShard struct {
+	sync.RWMutex
+	tokens map[string]*AuthenticatedToken
+}
+
+// NewTokenStore creates an empty TokenStore.
+func NewTokenStore() *TokenStore {
+	store := &TokenStore{}
+	for i := range store.shards {
+		store.shards[i] = &tokenShard{tokens: make(map[string]*AuthenticatedToken)}
+	}
+
+	return store
+}
+
+// shard returns the partition responsible for the key.
+func (s *TokenStore) shard(key string) *tokenShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return s.shards[hash.Sum32()%tokenStoreShards]
+}
+
+// Get returns the token stored under the key, or nil if there is none.
+func (s *TokenStore) Get(key string) *AuthenticatedToken {
+	shard := s.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	return shard.tokens[key]
+}
+
+// Set stores the token under the key, replacing any previous one.
+func (s *TokenStore) Set(key string, token *AuthenticatedToken) {
+	atomic.CompareAndSwapUint64(&token.LastUsed, 0, unixNow())
+
+	shard := s.shard(key)
+	shard.Lock()
+	shard.tokens[key] = token
+	shard.Unlock()
+
+	if s.persistence != nil {
+		s.persistence.Put(key, token)
+	}
+}
+
+// Delete removes the token stored under the key.
+func (s *TokenStore) Delete(key string) {
+	shard := s.shard(key)
+	shard.Lock()
+	delete(shard.tokens, key)
+	shard.Unlock()
+
+	if s.persistence != nil {
+		s.persistence.Delete(key)
+	}
+}
+
+// DeleteExpired removes every token that expired before now and returns how many were removed.
+func (s *TokenStore) DeleteExpired(now uint64) int {
+	return len(s.DeleteFunc(func(_ string, token *AuthenticatedToken) bool {
+		return token.Expired(now)
+	}))
+}
+
+// DeleteFunc removes every token fn returns true for and returns the keys that were removed.
+func (s *TokenStore) DeleteFunc(fn func(key string, token *AuthenticatedToken) bool) []string {
+	var removed []string
+	for _, shard := range s.shards {
+		shard.Lock()
+		for key, token := range shard.tokens {
+			if fn(key, token) {
+				delete(shard.tokens, key)
+				removed = append(removed, key)
+			}
+		}
+		shard.Unlock()
+	}
+
+	if s.persistence != nil && len(removed) > 0 {
+		s.persistence.Delete(removed...)
+	}
+
+	return removed
+}
+
+// Range calls fn for every stored token until fn returns false. Each shard is read-locked while it is
+// visited, so fn must not modify the store.
+func (s *TokenStore) Range(fn func(key string, token *AuthenticatedToken) bool) {
+	for _, shard := range s.shards {
+		shard.RLock()
+		for key, token := range shard.tokens {
+			if !fn(key, token) {
+				shard.RUnlock()
+				return
+			}
+		}
+		shard.RUnlock()
+	}
+}
+
+// Len returns the number of stored tokens.
+func (s *TokenStore) Len() int {
+	count := 0
+	for _, shard := range s.shards {
+		shard.RLock()
+		count += len(shard.tokens)
+		shard.RUnlock()
+	}
+
+	return count
+}
+
+// Expired reports whether the token's TTL is before the given UNIX timestamp.
+func (t *AuthenticatedToken) Expired(now uint64) bool {
+	return atomic.LoadUint64(&t.TTL) <= now
+}
+
+// refresh records the use of the token and slides its TTL forward in sliding expiry mode. Both are updated
+// atomically as tokens are shared between clients.
+func (t *AuthenticatedToken) refresh() {
+	atomic.StoreUint64(&t.LastUsed, unixNow())
+	if *expiryMode == "absolute" {
+		return
+	}
+
+	atomic.StoreUint64(&t.TTL, t.nextTTL())
+}
+
+// nextTTL returns the TTL the token is granted from now: its own lifetime or the flag default, never past
+// its absolute expiry.
+func (t *AuthenticatedToken) nextTTL() uint64 {
+	ttl := newTTL()
+	if t.Lifetime != 0 {
+		ttl = unixNow() + t.Lifetime
+	}
+
+	if t.ExpiresAt != 0 {
+		ttl = min(ttl, t.ExpiresAt)
+	}
+
+	return ttl
+}
+
+// unixNow returns the current time as a UNIX timestamp, the unit used by token TTLs.
+func unixNow() uint64 {
+	return uint64(time.Now().Unix())
+}
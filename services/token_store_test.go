@@ -0,0 +1,133 @@
+package services
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTokenStoreSetGetDelete(t *testing.T) {
+	store := NewTokenStore()
+	token := &AuthenticatedToken{TeamID: 1, TTL: unixNow() + 60}
+
+	if got := store.Get("client::key"); got != nil {
+		t.Fatalf("Get on an empty store = %v, want nil", got)
+	}
+
+	store.Set("client::key", token)
+	if got := store.Get("client::key"); got != token {
+		t.Fatalf("Get = %v, want the stored token", got)
+	}
+	if token.LastUsed == 0 {
+		t.Error("Set did not record the last use of the token")
+	}
+	if got := store.Len(); got != 1 {
+		t.Errorf("Len = %d, want 1", got)
+	}
+
+	store.Delete("client::key")
+	if got := store.Get("client::key"); got != nil {
+		t.Errorf("Get after Delete = %v, want nil", got)
+	}
+	if got := store.Len(); got != 0 {
+		t.Errorf("Len after Delete = %d, want 0", got)
+	}
+}
+
+func TestTokenStoreDeleteExpired(t *testing.T) {
+	store := NewTokenStore()
+	now := unixNow()
+	for i := 0; i < 100; i++ {
+		ttl := now + 60
+		if i%2 == 0 {
+			ttl = now - 1
+		}
+		store.Set("client-"+strconv.Itoa(i)+"::key", &AuthenticatedToken{TTL: ttl})
+	}
+
+	if removed := store.DeleteExpired(now); removed != 50 {
+		t.Errorf("DeleteExpired removed %d tokens, want 50", removed)
+	}
+	if got := store.Len(); got != 50 {
+		t.Errorf("Len = %d, want 50", got)
+	}
+
+	store.Range(func(key string, token *AuthenticatedToken) bool {
+		if token.Expired(now) {
+			t.Errorf("expired token %s was kept", key)
+		}
+		return true
+	})
+}
+
+func TestTokenStoreDeleteFunc(t *testing.T) {
+	store := NewTokenStore()
+	for i := 0; i < 10; i++ {
+		store.Set("client-"+strconv.Itoa(i)+"::key", &AuthenticatedToken{TeamID: uint64(i % 2), TTL: unixNow() + 60})
+	}
+
+	removed := store.DeleteFunc(func(_ string, token *AuthenticatedToken) bool {
+		return token.TeamID == 1
+	})
+	if len(removed) != 5 {
+		t.Fatalf("DeleteFunc removed %v, want 5 keys", removed)
+	}
+	for _, key := range removed {
+		if store.Get(key) != nil {
+			t.Errorf("removed key %s is still stored", key)
+		}
+	}
+}
+
+func TestTokenStoreRangeStops(t *testing.T) {
+	store := NewTokenStore()
+	for i := 0; i < 10; i++ {
+		store.Set("client-"+strconv.Itoa(i)+"::key", &AuthenticatedToken{TTL: unixNow() + 60})
+	}
+
+	visited := 0
+	store.Range(func(string, *AuthenticatedToken) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Errorf("Range visited %d tokens after fn returned false, want 3", visited)
+	}
+}
+
+func TestTokenStoreConcurrentAccess(t *testing.T) {
+	store := NewTokenStore()
+	now := unixNow()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "client-" + strconv.Itoa(i%20) + "::key"
+			for j := 0; j < 50; j++ {
+				switch j % 5 {
+				case 0:
+					store.Set(key, &AuthenticatedToken{TTL: now + uint64(j%2)*60})
+				case 1:
+					if token := store.Get(key); token != nil {
+						token.refresh()
+					}
+				case 2:
+					store.DeleteExpired(now)
+				case 3:
+					store.Range(func(_ string, token *AuthenticatedToken) bool {
+						return !token.Expired(now)
+					})
+				default:
+					store.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := store.Len(); got > 20 {
+		t.Errorf("Len = %d, want at most one token per key", got)
+	}
+}
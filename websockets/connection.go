@@ -0,0 +1,591 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Define flags for the managed Reverb connection.
+var (
+	reconnectMin = flag.Duration("reverb-reconnect-min", time.Second, "Initial delay before reconnecting to Reverb")
+	reconnectMax = flag.Duration("reverb-reconnect-max", time.Minute, "Maximum delay between reconnection attempts")
+
+	activityTimeout = flag.Duration("reverb-activity-timeout", 120*time.Second, "Inactivity after which Reverb is pinged, lowered to the timeout announced by Reverb")
+	pongTimeout     = flag.Duration("reverb-pong-timeout", 30*time.Second, "Time Reverb has to answer a ping before the connection is replaced")
+)
+
+const (
+	writeTimeout     = 10 * time.Second // Bounds a single write, so a stalled socket is detected and replaced
+	drainTimeout     = 5 * time.Second  // Bounds the writing of the queued events on Close
+	handshakeTimeout = 10 * time.Second // Bounds the wait for pusher:connection_established
+	stableConnection = 30 * time.Second // Time a connection must stay established before the backoff starts over
+)
+
+// errPongTimeout is recorded when Reverb did not answer a ping in time.
+var errPongTimeout = errors.New("no pong received from reverb")
+
+// State is the state of the Reverb connection.
+type State string
+
+const (
+	StateConnecting    State = "connecting"    // Dialing, or waiting to dial again
+	StateConnected     State = "connected"     // Events are written to the socket
+	StateClosed        State = "closed"        // Closed by Close, events are dropped
+	StateMisconfigured State = "misconfigured" // The HTTP API refuses the app ID, key or secret, events are dropped
+)
+
+// Status describes the Reverb connection and its event queue.
+type Status struct {
+	State             State    `json:"state"`
+	Queued            int      `json:"queued"`               // Events waiting to be written
+	Dropped           uint64   `json:"dropped"`              // Events dropped because the queue was full, Reverb rejected them or the connection closed
+	Sent              uint64   `json:"sent"`                 // Events written to the socket
+	QueueLatencyAvgMs float64  `json:"queue_latency_avg_ms"` // Average time from queueing an event to sending it
+	QueueLatencyMaxMs float64  `json:"queue_latency_max_ms"` // Longest time from queueing an event to sending it
+	Reconnects        uint64   `json:"reconnects"`           // Connections established after the first one
+	ConnectedSince    uint64   `json:"connected_since"`      // Start of the current connection, in UNIX milliseconds, 0 if none
+	SocketID          string   `json:"socket_id,omitempty"`  // Socket ID assigned by Reverb to the current connection
+	Subscriptions     []string `json:"subscriptions"`        // Channels Reverb confirmed the subscription to
+	LastError         string   `json:"last_error,omitempty"`
+}
+
+// connection is a Reverb connection that reconnects with jittered backoff. Events are queued by any
+// goroutine and written by a single writer goroutine, as a socket supports a single concurrent writer and
+// MQTT clients must not wait for the panel.
+type connection struct {
+	*eventQueue
+
+	url      string
+	control  chan []byte          // Protocol messages, written before any waiting event
+	attached chan *websocket.Conn // New sockets handed to the writer
+	done     chan struct{}        // Closed when the writer stopped
+	stop     context.CancelFunc
+
+	authorize func(socketID, channel string) string // Signs subscriptions to private channels, nil if unavailable
+
+	mutex          sync.Mutex
+	conn           *websocket.Conn // Current socket, nil while disconnected
+	state          State
+	socketID       string          // Socket ID of the current socket
+	channels       []string        // Channels subscribed to on every connection, besides those events are sent on
+	subscribed     map[string]bool // Channels whose subscription Reverb confirmed on the current socket
+	connections    uint64
+	connectedSince time.Time
+	lastError      error
+}
+
+// newConnection creates a connection to the URL. It is not dialed before start is called.
+func newConnection(url string) *connection {
+	return &connection{
+		eventQueue: newEventQueue(),
+		url:        url,
+		control:    make(chan []byte, 16),
+		attached:   make(chan *websocket.Conn),
+		done:       make(chan struct{}),
+		state:      StateConnecting,
+		subscribed: make(map[string]bool),
+	}
+}
+
+// start connects in the background and starts the writer, reading incoming messages with handle.
+func (c *connection) start(handle func(message []byte)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stop = cancel
+
+	go c.run(ctx, handle)
+	go c.dispatch(ctx)
+}
+
+// run keeps the connection up until the context is canceled.
+func (c *connection) run(ctx context.Context, handle func(message []byte)) {
+	delay := *reconnectMin
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.url, nil)
+		if err == nil {
+			var uptime time.Duration
+			uptime, err = c.serve(ctx, conn, handle)
+
+			// A Reverb dropping connections right after accepting them is backed off like an unreachable one.
+			if uptime >= stableConnection {
+				delay = *reconnectMin
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.fail(err)
+		log.Println("reverb:", err, "- reconnecting")
+
+		// Full jitter keeps brokers from reconnecting in lockstep after a Reverb restart.
+		wait := delay/2 + rand.N(delay/2+1)
+		delay = min(2*delay, *reconnectMax)
+
+		// Reverb tells with the code of its error whether and when to reconnect.
+		var pusherErr *PusherError
+		if errors.As(err, &pusherErr) {
+			switch {
+			case pusherErr.Fatal():
+				wait, delay = *reconnectMax, *reconnectMax
+			case pusherErr.Immediate():
+				wait = 0
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve waits for Reverb to establish the connection, hands the socket to the writer and reads from it until
+// it fails, and returns how long the connection was established. Protocol messages are handled here, any other
+// message by handle.
+func (c *connection) serve(ctx context.Context, conn *websocket.Conn, handle func(message []byte)) (time.Duration, error) {
+	established, err := handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	c.socketID = established.SocketID
+	c.subscribed = make(map[string]bool)
+	c.mutex.Unlock()
+
+	select {
+	case c.attached <- conn:
+	case <-ctx.Done():
+		_ = conn.Close()
+		return 0, ctx.Err()
+	}
+
+	connected := time.Now()
+	log.Printf("reverb: connected to %s as %s", c.url, established.SocketID)
+
+	// Ping Reverb after the inactivity it announced, if it is lower than the flag.
+	timeout := *activityTimeout
+	if established.ActivityTimeout > 0 {
+		timeout = min(timeout, time.Duration(established.ActivityTimeout)*time.Second)
+	}
+
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	keepaliveCtx, stopKeepalive := context.WithCancel(ctx)
+	defer stopKeepalive()
+	timedOut := make(chan struct{})
+	go c.keepalive(keepaliveCtx, conn, timeout, &lastActivity, timedOut)
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-timedOut:
+				return time.Since(connected), errPongTimeout // The keepalive closed the socket.
+			default:
+			}
+
+			c.deactivate(conn, err)
+			return time.Since(connected), c.closeError(err)
+		}
+		lastActivity.Store(time.Now().UnixNano())
+
+		var message pusherMessage
+		if err = json.Unmarshal(raw, &message); err != nil {
+			log.Println("reverb: read:", err)
+			continue
+		}
+
+		if !c.handleProtocol(&message) {
+			handle(raw)
+		}
+	}
+}
+
+// handshake reads pusher:connection_established, or the error Reverb rejected the connection with.
+func handshake(conn *websocket.Conn) (*connectionEstablished, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var message pusherMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		return nil, err
+	}
+
+	switch message.Event {
+	case pusherConnectionEstablished:
+		var established connectionEstablished
+		if err := message.decode(&established); err != nil {
+			return nil, err
+		}
+		return &established, nil
+	case pusherError:
+		pusherErr := &PusherError{}
+		if err := message.decode(pusherErr); err != nil {
+			return nil, err
+		}
+		return nil, pusherErr
+	default:
+		return nil, fmt.Errorf("unexpected %s before %s", message.Event, pusherConnectionEstablished)
+	}
+}
+
+// handleProtocol handles the messages of the Pusher protocol and reports whether the message was one.
+func (c *connection) handleProtocol(message *pusherMessage) bool {
+	switch message.Event {
+	case pusherPing:
+		c.sendControl(pusherEvent(pusherPong, map[string]string{}))
+	case pusherPong:
+		// Any message counts as activity, nothing else to do.
+	case pusherSubscriptionSucceeded:
+		c.mutex.Lock()
+		c.subscribed[message.Channel] = true
+		c.mutex.Unlock()
+	case pusherSubscriptionError:
+		log.Printf("reverb: subscribing to %s failed: %s", message.Channel, message.payload())
+	case pusherError:
+		pusherErr := &PusherError{}
+		if err := message.decode(pusherErr); err != nil {
+			log.Println("reverb: read:", err)
+			return true
+		}
+
+		// Errors with a code are followed by Reverb closing the connection, the others are informational.
+		log.Println("reverb:", pusherErr)
+		c.mutex.Lock()
+		c.lastError = pusherErr
+		c.mutex.Unlock()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// keepalive pings Reverb after the activity timeout without any message, and closes timedOut and the socket
+// if no message arrives within the pong timeout.
+func (c *connection) keepalive(ctx context.Context, conn *websocket.Conn, timeout time.Duration, lastActivity *atomic.Int64, timedOut chan struct{}) {
+	for {
+		idle := time.Since(time.Unix(0, lastActivity.Load()))
+		if idle < timeout {
+			select {
+			case <-time.After(timeout - idle):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		pinged := time.Now()
+		c.sendControl(pusherEvent(pusherPing, map[string]string{}))
+
+		select {
+		case <-time.After(*pongTimeout):
+		case <-ctx.Done():
+			return
+		}
+
+		if time.Unix(0, lastActivity.Load()).Before(pinged) {
+			close(timedOut)
+			c.deactivate(conn, errPongTimeout)
+			return
+		}
+	}
+}
+
+// closeError returns the Pusher error a close frame carries, so its code decides how to reconnect.
+func (c *connection) closeError(err error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code >= 4000 && closeErr.Code < 4300 {
+		return &PusherError{Message: closeErr.Text, Code: closeErr.Code}
+	}
+
+	return err
+}
+
+// dispatch is the single writer of the connection. It writes protocol messages first, then the queued
+// events in order, keeping an event that failed to write until the next socket is attached.
+func (c *connection) dispatch(ctx context.Context) {
+	defer close(c.done)
+
+	var conn *websocket.Conn
+	var joined map[string]bool // Channels the socket subscribed to
+	var pending *outgoing
+	for {
+		if conn == nil {
+			select {
+			case conn = <-c.attached:
+				conn, joined = c.activate(conn)
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if pending == nil {
+			select {
+			case conn = <-c.attached:
+				conn, joined = c.activate(conn)
+				continue
+			case message := <-c.control:
+				conn = c.write(conn, message)
+				continue
+			default:
+			}
+
+			select {
+			case conn = <-c.attached:
+				conn, joined = c.activate(conn)
+			case message := <-c.control:
+				conn = c.write(conn, message)
+			case event := <-c.events:
+				pending = &event
+			case <-ctx.Done():
+				c.drain(conn, joined)
+				return
+			}
+			continue
+		}
+
+		if conn = c.deliver(conn, joined, pending); conn != nil {
+			pending = nil
+		}
+	}
+}
+
+// deliver writes an event, subscribing the socket to its channel first. It returns nil if the socket failed.
+func (c *connection) deliver(conn *websocket.Conn, joined map[string]bool, event *outgoing) *websocket.Conn {
+	if event.channel != "" && !joined[event.channel] {
+		if conn = c.write(conn, c.subscription(event.channel)); conn == nil {
+			return nil
+		}
+		joined[event.channel] = true
+	}
+
+	message, _ := json.Marshal(pusherMessage{Event: string(event.event), Channel: event.channel, Data: event.data})
+	if conn = c.write(conn, message); conn != nil {
+		c.record(event.queued)
+	}
+
+	return conn
+}
+
+// activate subscribes a new socket to the channels and makes it current. It returns nil if it failed, and
+// the channels the socket subscribed to.
+func (c *connection) activate(conn *websocket.Conn) (*websocket.Conn, map[string]bool) {
+	c.mutex.Lock()
+	channels := append([]string(nil), c.channels...)
+	c.mutex.Unlock()
+
+	joined := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		if conn = c.write(conn, c.subscription(channel)); conn == nil {
+			return nil, nil
+		}
+		joined[channel] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn = conn
+	c.state = StateConnected
+	c.connections++
+	c.connectedSince = time.Now()
+	c.lastError = nil
+	return conn, joined
+}
+
+// subscription returns the message subscribing the current socket to a channel, signed for private channels.
+func (c *connection) subscription(channel string) []byte {
+	data := map[string]string{"channel": channel}
+	if strings.HasPrefix(channel, privateChannelPrefix) && c.authorize != nil {
+		c.mutex.Lock()
+		socketID := c.socketID
+		c.mutex.Unlock()
+
+		data["auth"] = c.authorize(socketID, channel)
+	}
+
+	return pusherEvent(pusherSubscribe, data)
+}
+
+// write writes a text message to the socket within the write timeout. It returns nil if the socket failed,
+// which is then closed so the reader reconnects.
+func (c *connection) write(conn *websocket.Conn, message []byte) *websocket.Conn {
+	_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		log.Println("reverb: write:", err)
+		c.deactivate(conn, err)
+		return nil
+	}
+
+	return conn
+}
+
+// drain writes the events still queued when the connection is closed, within the drain timeout.
+func (c *connection) drain(conn *websocket.Conn, joined map[string]bool) {
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case event := <-c.events:
+			if conn = c.deliver(conn, joined, &event); conn == nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deactivate forgets the socket after it failed, unless it was already replaced.
+func (c *connection) deactivate(conn *websocket.Conn, err error) {
+	_ = conn.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != conn {
+		return
+	}
+
+	c.conn = nil
+	c.socketID = ""
+	c.subscribed = make(map[string]bool)
+	if c.state == StateConnected {
+		c.state = StateConnecting
+	}
+	c.lastError = err
+}
+
+// fail records a failed connection attempt.
+func (c *connection) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state != StateClosed {
+		c.state = StateConnecting
+	}
+	c.lastError = err
+}
+
+// publish queues the event for the channel without waiting, applying the drop policy when the queue is full.
+func (c *connection) publish(channel string, eventType EventType, data any) {
+	c.mutex.Lock()
+	closed := c.state == StateClosed
+	c.mutex.Unlock()
+
+	if closed {
+		c.dropped.Add(1)
+		return
+	}
+
+	c.push(channel, eventType, data)
+}
+
+// sendControl queues a protocol message, which is only useful on the current socket and dropped while
+// disconnected.
+func (c *connection) sendControl(message []byte) {
+	c.mutex.Lock()
+	connected := c.conn != nil
+	c.mutex.Unlock()
+
+	if !connected {
+		return
+	}
+
+	select {
+	case c.control <- message:
+	default:
+	}
+}
+
+// subscribe joins the channel now, if connected, and on every later connection.
+func (c *connection) subscribe(channel string) {
+	c.mutex.Lock()
+	if slices.Contains(c.channels, channel) {
+		c.mutex.Unlock()
+		return
+	}
+	c.channels = append(c.channels, channel)
+	c.mutex.Unlock()
+
+	c.sendControl(c.subscription(channel))
+}
+
+// unsubscribe leaves the channel.
+func (c *connection) unsubscribe(channel string) {
+	c.mutex.Lock()
+	c.channels = slices.DeleteFunc(c.channels, func(subscribed string) bool { return subscribed == channel })
+	delete(c.subscribed, channel)
+	c.mutex.Unlock()
+
+	c.sendControl(pusherEvent(pusherUnsubscribe, map[string]string{"channel": channel}))
+}
+
+// status returns the current status of the connection.
+func (c *connection) status() Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	status := Status{
+		State:      c.state,
+		Reconnects: max(c.connections, 1) - 1,
+	}
+	c.fill(&status)
+	if c.conn != nil {
+		status.ConnectedSince = uint64(c.connectedSince.UnixMilli())
+		status.SocketID = c.socketID
+	}
+
+	status.Subscriptions = make([]string, 0, len(c.subscribed))
+	for channel := range c.subscribed {
+		status.Subscriptions = append(status.Subscriptions, channel)
+	}
+	slices.Sort(status.Subscriptions)
+	if c.lastError != nil {
+		status.LastError = c.lastError.Error()
+	}
+
+	return status
+}
+
+// close stops reconnecting, writes the queued events if connected and closes the socket. Messages sent
+// afterwards are dropped.
+func (c *connection) close() error {
+	c.mutex.Lock()
+	c.state = StateClosed
+	c.mutex.Unlock()
+
+	if c.stop != nil {
+		c.stop()
+		<-c.done
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
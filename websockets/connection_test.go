@@ -0,0 +1,374 @@
+package websockets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout bounds every wait of the tests for the fake Reverb or the connection.
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	// Short timeouts keep the keepalive and reconnection tests fast. Set once, as the connection goroutines of
+	// earlier tests may still read them.
+	*reconnectMin = 400 * time.Millisecond
+	*reconnectMax = 2 * time.Second
+	*activityTimeout = 100 * time.Millisecond
+	*pongTimeout = 100 * time.Millisecond
+
+	os.Exit(m.Run())
+}
+
+// fakeReverb is a websocket server speaking the Pusher protocol like Reverb.
+type fakeReverb struct {
+	*httptest.Server
+	accepted chan *reverbSocket
+	greet    func(index int, socket *reverbSocket) // Sends the first message of the index-th connection
+	silent   atomic.Bool                           // Leaves the pings of the connection unanswered
+	count    atomic.Int64
+}
+
+// reverbSocket is a connection accepted by the fake Reverb.
+type reverbSocket struct {
+	conn     *websocket.Conn
+	mutex    sync.Mutex         // Serializes writes, as a socket supports a single concurrent writer
+	received chan pusherMessage // Messages of the connection, except its pings
+	pings    atomic.Int64
+	closed   chan struct{} // Closed once the connection failed
+}
+
+// newFakeReverb starts a fake Reverb establishing every connection, unless greet is replaced.
+func newFakeReverb(t *testing.T) *fakeReverb {
+	t.Helper()
+
+	reverb := &fakeReverb{
+		accepted: make(chan *reverbSocket, 16),
+		greet: func(_ int, socket *reverbSocket) {
+			socket.send(pusherConnectionEstablished, "", connectionEstablished{SocketID: "1234.5678", ActivityTimeout: 120})
+		},
+	}
+
+	var sockets sync.WaitGroup
+	upgrader := websocket.Upgrader{}
+	reverb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		sockets.Add(1)
+		defer sockets.Done()
+
+		socket := &reverbSocket{
+			conn:     conn,
+			received: make(chan pusherMessage, 64),
+			closed:   make(chan struct{}),
+		}
+		defer close(socket.closed)
+		defer conn.Close()
+
+		reverb.accepted <- socket
+		reverb.greet(int(reverb.count.Add(1))-1, socket)
+		socket.read(&reverb.silent)
+	}))
+
+	t.Cleanup(func() {
+		reverb.Close()
+		reverb.CloseClientConnections()
+		sockets.Wait()
+	})
+	return reverb
+}
+
+// url returns the websocket URL of the fake Reverb.
+func (f *fakeReverb) url() string {
+	return "ws" + strings.TrimPrefix(f.URL, "http")
+}
+
+// accept returns the next connection accepted by the fake Reverb.
+func (f *fakeReverb) accept(t *testing.T) *reverbSocket {
+	t.Helper()
+
+	select {
+	case socket := <-f.accepted:
+		return socket
+	case <-time.After(testTimeout):
+		t.Fatal("no connection to the fake reverb")
+		return nil
+	}
+}
+
+// read receives the messages of the connection until it fails, answering its pings unless silent.
+func (s *reverbSocket) read(silent *atomic.Bool) {
+	for {
+		var message pusherMessage
+		if err := s.conn.ReadJSON(&message); err != nil {
+			return
+		}
+
+		if message.Event == pusherPing {
+			s.pings.Add(1)
+			if !silent.Load() {
+				s.send(pusherPong, "", map[string]string{})
+			}
+			continue
+		}
+
+		s.received <- message
+	}
+}
+
+// send writes a Pusher message, encoding its data as a JSON string like Reverb.
+func (s *reverbSocket) send(event, channel string, data any) {
+	encoded, _ := json.Marshal(data)
+	data, _ = json.Marshal(string(encoded))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_ = s.conn.WriteJSON(pusherMessage{Event: event, Channel: channel, Data: data.([]byte)})
+}
+
+// closeWith closes the connection with a close frame carrying the code.
+func (s *reverbSocket) closeWith(code int, text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+}
+
+// next returns the next message of the connection.
+func (s *reverbSocket) next(t *testing.T) pusherMessage {
+	t.Helper()
+
+	select {
+	case message := <-s.received:
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message from the connection")
+		return pusherMessage{}
+	}
+}
+
+// startConnection starts a connection to the fake Reverb, closed when the test ends.
+func startConnection(t *testing.T, reverb *fakeReverb, handle func(message []byte)) *connection {
+	t.Helper()
+
+	if handle == nil {
+		handle = func([]byte) {}
+	}
+
+	c := newConnection(reverb.url())
+	c.start(handle)
+	t.Cleanup(func() { _ = c.close() })
+	return c
+}
+
+// eventually waits until the condition holds, failing with the message otherwise.
+func eventually(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// channelOf returns the channel a pusher:subscribe message subscribes to.
+func channelOf(t *testing.T, message pusherMessage) string {
+	t.Helper()
+
+	var data struct {
+		Channel string `json:"channel"`
+	}
+	if err := message.decode(&data); err != nil {
+		t.Fatalf("decode %s: %v", message.Event, err)
+	}
+
+	return data.Channel
+}
+
+func TestConnectionEstablished(t *testing.T) {
+	reverb := newFakeReverb(t)
+	c := startConnection(t, reverb, nil)
+	socket := reverb.accept(t)
+
+	eventually(t, func() bool {
+		status := c.status()
+		return status.State == StateConnected && status.SocketID == "1234.5678"
+	}, "connection not established")
+
+	c.publish("team.1", MqttClientConnected, map[string]string{"id": "client"})
+
+	subscribe := socket.next(t)
+	if subscribe.Event != pusherSubscribe || channelOf(t, subscribe) != "team.1" {
+		t.Fatalf("first message = %s %s, want a subscription to team.1", subscribe.Event, subscribe.Data)
+	}
+
+	event := socket.next(t)
+	if event.Event != string(MqttClientConnected) || event.Channel != "team.1" || string(event.payload()) != `{"id":"client"}` {
+		t.Fatalf("event = %s on %q with %s", event.Event, event.Channel, event.payload())
+	}
+
+	eventually(t, func() bool { return c.status().Sent == 1 }, "sent count is not 1")
+}
+
+func TestConnectionSubscriptionSucceeded(t *testing.T) {
+	reverb := newFakeReverb(t)
+	handled := make(chan []byte, 1)
+	c := startConnection(t, reverb, func(message []byte) { handled <- message })
+	c.subscribe("mqtt-commands")
+	socket := reverb.accept(t)
+
+	subscribe := socket.next(t)
+	if subscribe.Event != pusherSubscribe || channelOf(t, subscribe) != "mqtt-commands" {
+		t.Fatalf("first message = %s %s, want a subscription to mqtt-commands", subscribe.Event, subscribe.Data)
+	}
+
+	if subscriptions := c.status().Subscriptions; len(subscriptions) != 0 {
+		t.Fatalf("subscriptions = %v before reverb confirmed them", subscriptions)
+	}
+
+	socket.send(pusherSubscriptionSucceeded, "mqtt-commands", map[string]string{})
+	eventually(t, func() bool {
+		return slices.Equal(c.status().Subscriptions, []string{"mqtt-commands"})
+	}, "subscriptions are not [mqtt-commands]")
+
+	// Protocol messages are handled by the connection, any other message is passed on.
+	socket.send(string(MqttRevokeCredentials), "mqtt-commands", map[string]int{"team_id": 1})
+	select {
+	case message := <-handled:
+		var incoming pusherMessage
+		if err := json.Unmarshal(message, &incoming); err != nil || incoming.Event != string(MqttRevokeCredentials) {
+			t.Fatalf("handled %s, want the %s event", message, MqttRevokeCredentials)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the event was not handled")
+	}
+}
+
+func TestConnectionAnswersPings(t *testing.T) {
+	reverb := newFakeReverb(t)
+	c := startConnection(t, reverb, nil)
+	socket := reverb.accept(t)
+	eventually(t, func() bool { return c.status().State == StateConnected }, "connection not established")
+
+	socket.send(pusherPing, "", map[string]string{})
+	if pong := socket.next(t); pong.Event != pusherPong {
+		t.Fatalf("answer to ping = %s, want %s", pong.Event, pusherPong)
+	}
+
+	// Pinged after every activity timeout and answered, the connection is kept.
+	eventually(t, func() bool { return socket.pings.Load() >= 3 }, "pinged less than 3 times")
+	select {
+	case <-reverb.accepted:
+		t.Fatal("the connection was replaced although reverb answered its pings")
+	case <-socket.closed:
+		t.Fatal("the connection was closed although reverb answered its pings")
+	default:
+	}
+
+	if state := c.status().State; state != StateConnected {
+		t.Fatalf("state = %s, want %s", state, StateConnected)
+	}
+}
+
+func TestConnectionPongTimeout(t *testing.T) {
+	reverb := newFakeReverb(t)
+	reverb.silent.Store(true)
+	c := startConnection(t, reverb, nil)
+	socket := reverb.accept(t)
+
+	select {
+	case <-socket.closed:
+	case <-time.After(testTimeout):
+		t.Fatal("the connection was kept although reverb did not answer its ping")
+	}
+
+	if socket.pings.Load() == 0 {
+		t.Fatal("the connection was closed without a ping")
+	}
+
+	reverb.silent.Store(false)
+	reverb.accept(t)
+	eventually(t, func() bool {
+		status := c.status()
+		return status.State == StateConnected && status.Reconnects == 1
+	}, "not reconnected after the pong timeout")
+}
+
+func TestConnectionPusherErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      int
+		close     bool          // Sent as a close frame after the connection was established instead of pusher:error
+		reconnect bool          // Whether the connection is re-established within the test timeout
+		minWait   time.Duration // Shortest acceptable wait before reconnecting
+		maxWait   time.Duration // Longest acceptable wait before reconnecting
+	}{
+		{name: "fatal error", code: 4001},
+		{name: "fatal close", code: 4009, close: true},
+		{name: "backoff error", code: 4100, reconnect: true, minWait: 150 * time.Millisecond, maxWait: time.Second},
+		{name: "backoff close", code: 4100, close: true, reconnect: true, minWait: 150 * time.Millisecond, maxWait: time.Second},
+		{name: "immediate error", code: 4200, reconnect: true, maxWait: 150 * time.Millisecond},
+		{name: "immediate close", code: 4201, close: true, reconnect: true, maxWait: 150 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reverb := newFakeReverb(t)
+			rejected := make(chan time.Time, 1)
+			establish := reverb.greet
+			reverb.greet = func(index int, socket *reverbSocket) {
+				if index > 0 {
+					establish(index, socket)
+					return
+				}
+
+				if test.close {
+					establish(index, socket)
+					time.Sleep(50 * time.Millisecond)
+					rejected <- time.Now()
+					socket.closeWith(test.code, "closed by reverb")
+					return
+				}
+
+				rejected <- time.Now()
+				socket.send(pusherError, "", PusherError{Message: "rejected by reverb", Code: test.code})
+			}
+
+			c := startConnection(t, reverb, nil)
+			reverb.accept(t)
+			sent := <-rejected
+
+			if !test.reconnect {
+				select {
+				case <-reverb.accepted:
+					t.Fatalf("reconnected after the fatal code %d", test.code)
+				case <-time.After(time.Second):
+				}
+
+				if status := c.status(); status.State != StateConnecting || !strings.Contains(status.LastError, "pusher error") {
+					t.Fatalf("status = %+v, want connecting with the pusher error", status)
+				}
+				return
+			}
+
+			reverb.accept(t)
+			if waited := time.Since(sent); waited < test.minWait || waited > test.maxWait {
+				t.Fatalf("reconnected after %s, want between %s and %s", waited, test.minWait, test.maxWait)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package websockets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define flags for the Pusher HTTP events API transport.
+var (
+	reverbAppID  = flag.String("reverb-app-id", "", "reverb app ID, required by the http transport")
+	reverbAPIURL = flag.String("reverb-api-url", "", "Base URL of the reverb HTTP API, defaults to http://{reverb-host}")
+	httpTimeout  = flag.Duration("reverb-http-timeout", 10*time.Second, "Timeout of a single request to the reverb HTTP API")
+	httpRetries  = flag.Int("reverb-http-retries", 3, "Retries of a request failing with a transport error, 429 or 5xx before its events are dropped")
+)
+
+const (
+	maxBatchEvents = 10                     // Events per request accepted by the batch endpoint
+	retryDelay     = 250 * time.Millisecond // Initial delay between retries, doubled on every attempt
+)
+
+// apiEvent is an event in the body of a Pusher HTTP API request. Its data is sent as a JSON string.
+type apiEvent struct {
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	Data    string `json:"data"`
+}
+
+// apiError is an HTTP API response other than 200.
+type apiError struct {
+	status int
+	body   string
+}
+
+// Error returns the status and body of the response.
+func (e *apiError) Error() string {
+	return fmt.Sprintf("reverb API responded with status %d: %s", e.status, e.body)
+}
+
+// retryable reports whether the request may succeed when sent again.
+func (e *apiError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= http.StatusInternalServerError
+}
+
+// misconfigured reports whether the app ID, key or secret was refused, which fails every request alike.
+func (e *apiError) misconfigured() bool {
+	return e.status == http.StatusUnauthorized || e.status == http.StatusForbidden || e.status == http.StatusNotFound
+}
+
+// invalidContent reports whether the events of the request were refused, so they may be accepted one by one.
+func (e *apiError) invalidContent() bool {
+	return e.status == http.StatusBadRequest || e.status == http.StatusRequestEntityTooLarge
+}
+
+// httpPublisher sends the queued events through the Pusher HTTP events API, in batches of the events
+// queued while the previous request was sent.
+type httpPublisher struct {
+	*eventQueue
+
+	baseURL string
+	appID   string
+	key     string
+	secret  string
+	client  *http.Client
+	done    chan struct{}      // Closed when the sender stopped
+	stop    context.CancelFunc // Stops taking events from the queue
+	abort   context.CancelFunc // Cancels the requests, drainTimeout after stop
+
+	mutex          sync.Mutex
+	state          State
+	connectedSince time.Time // First successful request since the last failure
+	lastError      error
+}
+
+// newHTTPPublisher creates the HTTP API client configured by flag.
+func newHTTPPublisher() (*httpPublisher, error) {
+	if *reverbAppID == "" || *reverbAppSecret == "" {
+		return nil, errors.New("reverb-app-id and reverb-app-secret are required by the http transport")
+	}
+
+	baseURL := *reverbAPIURL
+	if baseURL == "" {
+		baseURL = "http://" + *reverbHost
+	}
+
+	return &httpPublisher{
+		eventQueue: newEventQueue(),
+		baseURL:    baseURL,
+		appID:      *reverbAppID,
+		key:        *reverbAppKey,
+		secret:     *reverbAppSecret,
+		client:     &http.Client{Timeout: *httpTimeout},
+		done:       make(chan struct{}),
+		state:      StateConnecting,
+	}, nil
+}
+
+// start starts the sender in the background.
+func (p *httpPublisher) start() {
+	ctx, stop := context.WithCancel(context.Background())
+	requests, abort := context.WithCancel(context.Background())
+	p.stop, p.abort = stop, abort
+
+	log.Printf("sending events to %s", p.baseURL)
+	go p.dispatch(ctx, requests)
+}
+
+// dispatch is the single sender of the queue. Events queued while a request is sent are sent together by
+// the next one.
+func (p *httpPublisher) dispatch(ctx context.Context, requests context.Context) {
+	defer close(p.done)
+
+	for {
+		select {
+		case event := <-p.events:
+			p.send(requests, p.batch(event))
+		case <-ctx.Done():
+			p.drain(requests)
+			return
+		}
+	}
+}
+
+// batch returns the event followed by those already waiting, up to the batch limit of the API.
+func (p *httpPublisher) batch(first outgoing) []outgoing {
+	batch := []outgoing{first}
+	for len(batch) < maxBatchEvents {
+		select {
+		case event := <-p.events:
+			batch = append(batch, event)
+		default:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// drain sends the events still queued when the publisher is closed, until the requests are aborted.
+func (p *httpPublisher) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		select {
+		case event := <-p.events:
+			p.send(ctx, p.batch(event))
+		default:
+			return
+		}
+	}
+}
+
+// send posts a batch, retrying transport errors, 429 and 5xx responses. Batches rejected otherwise, e.g.
+// because an event is too large, are sent again one event at a time so only the faulty events are dropped.
+func (p *httpPublisher) send(ctx context.Context, batch []outgoing) {
+	err := p.post(ctx, batch)
+
+	// Only a batch refused for its events is sent again one event at a time, so the valid ones are delivered.
+	var rejected *apiError
+	if errors.As(err, &rejected) && rejected.invalidContent() && len(batch) > 1 {
+		for _, event := range batch {
+			p.send(ctx, []outgoing{event})
+		}
+		return
+	}
+
+	p.mutex.Lock()
+	p.lastError = err
+	if p.state != StateClosed {
+		switch {
+		case rejected != nil && rejected.misconfigured():
+			p.state = StateMisconfigured
+		case err != nil && (rejected == nil || rejected.retryable()):
+			p.state = StateConnecting
+		case p.state != StateConnected:
+			p.state = StateConnected
+			p.connectedSince = time.Now()
+		}
+	}
+	p.mutex.Unlock()
+
+	if err != nil {
+		log.Println("reverb:", err, "- dropping", len(batch), "events")
+		p.dropped.Add(uint64(len(batch)))
+		return
+	}
+
+	for _, event := range batch {
+		p.record(event.queued)
+	}
+}
+
+// post sends the batch to the events endpoint, or to the batch endpoint for several events.
+func (p *httpPublisher) post(ctx context.Context, batch []outgoing) error {
+	events := make([]apiEvent, len(batch))
+	for i, event := range batch {
+		events[i] = apiEvent{Name: string(event.event), Channel: event.channel, Data: string(event.data)}
+	}
+
+	path := "/apps/" + p.appID + "/events"
+	var payload any = map[string]any{"name": events[0].Name, "channels": []string{events[0].Channel}, "data": events[0].Data}
+	if len(events) > 1 {
+		path = "/apps/" + p.appID + "/batch_events"
+		payload = map[string]any{"batch": events}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		err = p.request(ctx, path, body)
+
+		var rejected *apiError
+		if err == nil || (errors.As(err, &rejected) && !rejected.retryable()) || attempt >= *httpRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(delay/2 + rand.N(delay/2+1)):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// request sends a single signed POST request with the JSON body.
+func (p *httpPublisher) request(ctx context.Context, path string, body []byte) error {
+	target := p.baseURL + path + "?" + p.sign(http.MethodPost, path, body, time.Now()).Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return &apiError{status: response.StatusCode, body: string(bytes.TrimSpace(message))}
+	}
+
+	return nil
+}
+
+// sign returns the authentication query parameters of a Pusher HTTP API request: the app key, timestamp,
+// version and body MD5, and the hex HMAC-SHA256 of "{method}\n{path}\n{sorted parameters}" keyed with the
+// app secret.
+func (p *httpPublisher) sign(method, path string, body []byte, now time.Time) url.Values {
+	bodyMD5 := md5.Sum(body)
+	query := url.Values{
+		"auth_key":       {p.key},
+		"auth_timestamp": {strconv.FormatInt(now.Unix(), 10)},
+		"auth_version":   {"1.0"},
+		"body_md5":       {hex.EncodeToString(bodyMD5[:])},
+	}
+
+	// Encode sorts the parameters by key, as required by the signature.
+	mac := hmac.New(sha256.New, []byte(p.secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + query.Encode()))
+	query.Set("auth_signature", hex.EncodeToString(mac.Sum(nil)))
+
+	return query
+}
+
+// publish queues the event without waiting, applying the drop policy when the queue is full.
+func (p *httpPublisher) publish(channel string, eventType EventType, data any) {
+	p.mutex.Lock()
+	closed := p.state == StateClosed
+	p.mutex.Unlock()
+
+	if closed {
+		p.dropped.Add(1)
+		return
+	}
+
+	p.push(channel, eventType, data)
+}
+
+// status returns the current status of the publisher.
+func (p *httpPublisher) status() Status {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := Status{State: p.state, Subscriptions: []string{}}
+	p.fill(&status)
+	if p.state == StateConnected {
+		status.ConnectedSince = uint64(p.connectedSince.UnixMilli())
+	}
+	if p.lastError != nil {
+		status.LastError = p.lastError.Error()
+	}
+
+	return status
+}
+
+// close sends the queued events within the drain timeout and stops the sender. Events published afterwards
+// are dropped.
+func (p *httpPublisher) close() error {
+	p.mutex.Lock()
+	p.state = StateClosed
+	p.mutex.Unlock()
+
+	if p.stop == nil {
+		return nil
+	}
+
+	p.stop()
+	abort := time.AfterFunc(drainTimeout, p.abort)
+	<-p.done
+	abort.Stop()
+	p.abort()
+
+	return nil
+}
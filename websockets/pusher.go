@@ -0,0 +1,96 @@
+package websockets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// pusherProtocol is the version of the Pusher protocol spoken with Reverb.
+const pusherProtocol = "7"
+
+// privateChannelPrefix marks channels that require a signed subscription.
+const privateChannelPrefix = "private-"
+
+// Events of the Pusher protocol handled by the connection itself.
+const (
+	pusherConnectionEstablished = "pusher:connection_established"
+	pusherError                 = "pusher:error"
+	pusherPing                  = "pusher:ping"
+	pusherPong                  = "pusher:pong"
+	pusherSubscribe             = "pusher:subscribe"
+	pusherUnsubscribe           = "pusher:unsubscribe"
+	pusherSubscriptionSucceeded = "pusher_internal:subscription_succeeded"
+	pusherSubscriptionError     = "pusher:subscription_error"
+)
+
+// pusherMessage is a message of the Pusher protocol.
+type pusherMessage struct {
+	Event   string          `json:"event"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// decode unmarshals the data of the message into out. Pusher encodes event data as a JSON string, which is
+// decoded first.
+func (m *pusherMessage) decode(out any) error {
+	return json.Unmarshal(m.payload(), out)
+}
+
+// payload returns the data of the message, with the JSON string encoding removed.
+func (m *pusherMessage) payload() json.RawMessage {
+	var encoded string
+	if json.Unmarshal(m.Data, &encoded) == nil {
+		return json.RawMessage(encoded)
+	}
+
+	return m.Data
+}
+
+// connectionEstablished is the data of pusher:connection_established.
+type connectionEstablished struct {
+	SocketID        string `json:"socket_id"`
+	ActivityTimeout int    `json:"activity_timeout"` // Seconds of inactivity after which the client should ping
+}
+
+// PusherError is an error reported by Reverb with pusher:error.
+type PusherError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"` // 0 if the error has no code, e.g. for a rejected client event
+}
+
+// Error returns the message and code of the error.
+func (e *PusherError) Error() string {
+	return fmt.Sprintf("pusher error %d: %s", e.Code, e.Message)
+}
+
+// Fatal reports whether the connection must not be re-established unchanged (codes 4000-4099), e.g. because
+// the application does not exist or is disabled.
+func (e *PusherError) Fatal() bool {
+	return e.Code >= 4000 && e.Code < 4100
+}
+
+// Immediate reports whether the connection may be re-established immediately (codes 4200-4299).
+func (e *PusherError) Immediate() bool {
+	return e.Code >= 4200 && e.Code < 4300
+}
+
+// pusherEvent returns a protocol message with the given data.
+func pusherEvent(event string, data any) []byte {
+	message, _ := json.Marshal(map[string]interface{}{
+		"event": event,
+		"data":  data,
+	})
+
+	return message
+}
+
+// channelAuth signs the subscription of a socket to a private channel as specified by Pusher: the app key,
+// followed by the hex HMAC-SHA256 of "{socket_id}:{channel}" keyed with the app secret.
+func channelAuth(key, secret, socketID, channel string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(socketID + ":" + channel))
+	return key + ":" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,106 @@
+package websockets
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Define flags for the outgoing event queue.
+var (
+	queueSize   = flag.Int("reverb-queue-size", 1000, "Maximum number of events waiting to be sent to Reverb")
+	queuePolicy = flag.String("reverb-queue-policy", "drop-oldest", "Event dropped when the queue is full: drop-oldest or drop-newest")
+)
+
+// outgoing is an event waiting in the queue.
+type outgoing struct {
+	channel string          // Channel the event is sent on
+	event   EventType       // Name of the event
+	data    json.RawMessage // JSON encoded data of the event
+	queued  time.Time
+}
+
+// eventQueue is the bounded queue of events waiting to be sent, shared by the transports. Events are
+// queued by any goroutine without waiting and sent by a single one.
+type eventQueue struct {
+	events chan outgoing // Events waiting to be sent, oldest first
+
+	dropped      atomic.Uint64
+	sent         atomic.Uint64
+	latencyTotal atomic.Int64 // Sum of the queue latencies, in nanoseconds
+	latencyMax   atomic.Int64 // Longest queue latency, in nanoseconds
+}
+
+// newEventQueue creates a queue sized by flag.
+func newEventQueue() *eventQueue {
+	return &eventQueue{events: make(chan outgoing, max(*queueSize, 1))}
+}
+
+// push queues the event without waiting, applying the drop policy when the queue is full.
+func (q *eventQueue) push(channel string, eventType EventType, data any) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		q.dropped.Add(1)
+		return
+	}
+
+	event := outgoing{channel: channel, event: eventType, data: encoded, queued: time.Now()}
+	for {
+		select {
+		case q.events <- event:
+			return
+		default:
+		}
+
+		q.dropped.Add(1)
+		if *queuePolicy == "drop-newest" {
+			return
+		}
+
+		// Make room by dropping the oldest event, then try again.
+		select {
+		case <-q.events:
+		default:
+		}
+	}
+}
+
+// record counts a sent event and the time it waited in the queue.
+func (q *eventQueue) record(queued time.Time) {
+	latency := int64(time.Since(queued))
+	q.sent.Add(1)
+	q.latencyTotal.Add(latency)
+	for {
+		current := q.latencyMax.Load()
+		if latency <= current || q.latencyMax.CompareAndSwap(current, latency) {
+			return
+		}
+	}
+}
+
+// fill sets the queue metrics of the status.
+func (q *eventQueue) fill(status *Status) {
+	status.Queued = len(q.events)
+	status.Dropped = q.dropped.Load()
+	status.Sent = q.sent.Load()
+	status.QueueLatencyMaxMs = milliseconds(q.latencyMax.Load())
+	if status.Sent > 0 {
+		status.QueueLatencyAvgMs = milliseconds(q.latencyTotal.Load() / int64(status.Sent))
+	}
+}
+
+// milliseconds converts nanoseconds to fractional milliseconds.
+func milliseconds(nanoseconds int64) float64 {
+	return float64(nanoseconds) / float64(time.Millisecond)
+}
+
+// validateQueuePolicy checks the flag selecting the drop policy.
+func validateQueuePolicy() error {
+	if *queuePolicy != "drop-oldest" && *queuePolicy != "drop-newest" {
+		return fmt.Errorf("unknown reverb queue policy %q", *queuePolicy)
+	}
+
+	return nil
+}
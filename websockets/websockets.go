@@ -3,16 +3,23 @@ package websockets
 import (
 	"encoding/json"
 	"flag"
-	"github.com/gorilla/websocket"
 	"log"
 	"net/url"
-	"os"
-	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-type ReverbConn websocket.Conn
-
-var WebsocketConn *websocket.Conn
+// Define flags for the Reverb connection.
+var (
+	reverbHost      = flag.String("reverb-host", "127.0.0.1:8080", "reverb service address")
+	reverbAppKey    = flag.String("reverb-app-key", "8jtblx730rmylh68ipdx", "reverb service address")
+	reverbAppSecret = flag.String("reverb-app-secret", "", "reverb app secret signing the subscriptions to private channels")
+	commandChannel  = flag.String("reverb-command-channel", "mqtt-commands", "reverb channel the panel sends broker commands on, empty to ignore commands")
+	teamChannel     = flag.String("reverb-team-channel", "private-team.{team_id}", "reverb channel template events of a team are sent on, empty to send every event on the fallback channel")
+	fallbackChannel = flag.String("reverb-fallback-channel", "mqtt", "reverb channel for events without a team")
+	transport       = flag.String("reverb-transport", "websocket", "How events are sent to reverb: websocket, or http for the Pusher HTTP events API")
+)
 
 type EventType string
 
@@ -23,48 +30,170 @@ const (
 	MqttClientSubscribed             = "MqttClientSubscribed"
 	MqttClientUnsubscribed           = "MqttClientUnsubscribed"
 	MqttClientPublished              = "MqttClientPublished"
+	MqttAuthBreakerChanged           = "MqttAuthBreakerChanged"
+	MqttAuthLockout                  = "MqttAuthLockout"
+	MqttTeamQuotaUsage               = "MqttTeamQuotaUsage"
+	MqttAccessDenied                 = "MqttAccessDenied"
 )
 
-func Init() {
-	reverbHost := flag.String("reverb-host", "127.0.0.1:8080", "reverb service address")
-	reverbAppKey := flag.String("reverb-app-key", "8jtblx730rmylh68ipdx", "reverb service address")
+// Commands the panel sends to the broker on the command channel.
+const (
+	MqttRevokeCredentials EventType = "MqttRevokeCredentials"
+)
+
+// CommandHandler handles the data of a command received from the panel.
+type CommandHandler func(data json.RawMessage)
 
+// publisher sends queued events to Reverb. It is implemented by the websocket connection and the HTTP API
+// client.
+type publisher interface {
+	publish(channel string, eventType EventType, data any)
+	status() Status
+	close() error
+}
+
+var (
+	reverb   publisher   // Transport of the events, nil before Init
+	socket   *connection // Websocket connection receiving commands, nil with the http transport
+	handlers sync.Map    // Command handlers by event type
+)
+
+// Init parses the flags and starts the transport selected by flag in the background. Events sent while Reverb
+// is unreachable, including at startup, are queued until it is back.
+func Init() {
 	flag.Parse()
 	log.SetFlags(0)
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	if err := validateQueuePolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	switch *transport {
+	case "websocket":
+		initWebsocket()
+	case "http":
+		client, err := newHTTPPublisher()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	u := url.URL{Scheme: "ws", Host: *reverbHost, Path: "/app/" + *reverbAppKey}
+		if *commandChannel != "" {
+			log.Println("reverb-transport is http, commands on", *commandChannel, "are not received")
+		}
+
+		client.start()
+		reverb = client
+	default:
+		log.Fatalf("unknown reverb transport %q", *transport)
+	}
+}
+
+// initWebsocket connects to Reverb over a websocket, which also receives the commands of the panel.
+func initWebsocket() {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     *reverbHost,
+		Path:     "/app/" + *reverbAppKey,
+		RawQuery: url.Values{"protocol": {pusherProtocol}, "client": {"broker-manager"}}.Encode(),
+	}
 	log.Printf("connecting to %s", u.String())
 
-	var err error
-	if WebsocketConn, _, err = websocket.DefaultDialer.Dial(u.String(), nil); err != nil {
-		log.Fatal("dial:", err)
+	socket = newConnection(u.String())
+	if *reverbAppSecret != "" {
+		socket.authorize = func(socketID, channel string) string {
+			return channelAuth(*reverbAppKey, *reverbAppSecret, socketID, channel)
+		}
+	} else if strings.HasPrefix(*teamChannel, privateChannelPrefix) {
+		log.Println("reverb-app-secret is not set, sending team events on", *fallbackChannel)
+		*teamChannel = ""
+	}
+
+	if *commandChannel != "" {
+		Subscribe(*commandChannel)
 	}
+
+	socket.start(readCommand)
+	reverb = socket
 }
 
+// Close sends the queued events and stops the transport.
 func Close() error {
-	return WebsocketConn.Close()
+	if reverb == nil {
+		return nil
+	}
+
+	return reverb.close()
 }
 
+// CurrentStatus returns the status of the transport.
+func CurrentStatus() Status {
+	if reverb == nil {
+		return Status{State: StateClosed}
+	}
+
+	return reverb.status()
+}
+
+// Subscribe joins a Reverb channel, now and after every reconnection. It has no effect with the http transport.
+func Subscribe(channel string) {
+	if socket != nil {
+		socket.subscribe(channel)
+	}
+}
+
+// Unsubscribe leaves a Reverb channel.
+func Unsubscribe(channel string) {
+	if socket != nil {
+		socket.unsubscribe(channel)
+	}
+}
+
+// Handle registers the handler of a command received from the panel.
+func Handle(eventType EventType, handler CommandHandler) {
+	handlers.Store(eventType, handler)
+}
+
+// SendMessage queues an event without a team for the panel, without waiting for it to be written.
 func SendMessage(eventType EventType, data any) {
-	message, _ := json.Marshal(map[string]interface{}{
-		"channel": "mqtt",
-		"event":   eventType,
-		"data":    data,
-	})
-
-	if err := WebsocketConn.WriteMessage(websocket.TextMessage, message); err != nil {
-		log.Println("write:", err)
+	SendTeamMessage(0, eventType, data)
+}
+
+// SendTeamMessage queues an event for the panel users of the team, without waiting for it to be written.
+// Events of team 0 are sent on the fallback channel.
+func SendTeamMessage(teamId uint64, eventType EventType, data any) {
+	if reverb == nil {
 		return
 	}
+
+	reverb.publish(TeamChannel(teamId), eventType, data)
+}
+
+// TeamChannel returns the channel the events of the team are sent on.
+func TeamChannel(teamId uint64) string {
+	if teamId == 0 || *teamChannel == "" {
+		return *fallbackChannel
+	}
+
+	return strings.ReplaceAll(*teamChannel, "{team_id}", strconv.FormatUint(teamId, 10))
 }
 
-func sendPing() {
-	message := []byte("{\"event\": \"pusher:ping\", \"data\": {}}")
-	if err := WebsocketConn.WriteMessage(websocket.TextMessage, message); err != nil {
-		log.Println("ping:", err)
+// readCommand dispatches a message received on the command channel to the handler of its event. Messages of
+// the other subscribed channels are never commands.
+func readCommand(message []byte) {
+	var incoming pusherMessage
+	if err := json.Unmarshal(message, &incoming); err != nil {
+		log.Println("read:", err)
+		return
+	}
+
+	if *commandChannel == "" || incoming.Channel != *commandChannel {
+		return
+	}
+
+	handler, ok := handlers.Load(EventType(incoming.Event))
+	if !ok {
 		return
 	}
+
+	handler.(CommandHandler)(incoming.payload())
 }